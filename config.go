@@ -26,9 +26,10 @@ type HTTPConfig struct {
 		PreferChacha20 bool   `json:"prefer_chacha20" yaml:"prefer_chacha20"`
 	} `json:"server_config" yaml:"server_config"`
 	Sniproxy []struct {
-		ServerName  string `json:"server_name" yaml:"server_name"`
-		ProxyPass   string `json:"proxy_pass" yaml:"proxy_pass"`
-		DialTimeout int    `json:"dial_timeout" yaml:"dial_timeout"`
+		ServerName        string `json:"server_name" yaml:"server_name"`
+		ProxyPass         string `json:"proxy_pass" yaml:"proxy_pass"`
+		DialTimeout       int    `json:"dial_timeout" yaml:"dial_timeout"`
+		SendProxyProtocol string `json:"send_proxy_protocol" yaml:"send_proxy_protocol"`
 	} `json:"sniproxy" yaml:"sniproxy"`
 	Forward struct {
 		Policy           string `json:"policy" yaml:"policy"`
@@ -40,6 +41,13 @@ type HTTPConfig struct {
 		PreferIpv6       bool   `json:"prefer_ipv6" yaml:"prefer_ipv6"`
 		Log              bool   `json:"log" yaml:"log"`
 		LogInterval      int64  `json:"log_interval" yaml:"log_interval"`
+		Cache            struct {
+			Enabled      bool   `json:"enabled" yaml:"enabled"`
+			MemorySize   int    `json:"memory_size" yaml:"memory_size"`
+			Dir          string `json:"dir" yaml:"dir"`
+			MaxSize      int64  `json:"max_size" yaml:"max_size"`
+			MaxEntrySize int64  `json:"max_entry_size" yaml:"max_entry_size"`
+		} `json:"cache" yaml:"cache"`
 	} `json:"forward" yaml:"forward"`
 	Tunnel struct {
 		Enabled    bool   `json:"enabled" yaml:"enabled"`
@@ -59,6 +67,11 @@ type HTTPConfig struct {
 			Root              string `json:"root" yaml:"root"`
 			AuthBasicUserFile string `json:"auth_basic_user_file" yaml:"auth_basic_user_file"`
 		} `json:"dav" yaml:"dav"`
+		Doh struct {
+			Enabled bool   `json:"enabled" yaml:"enabled"`
+			Policy  string `json:"policy" yaml:"policy"`
+			Log     bool   `json:"log" yaml:"log"`
+		} `json:"doh" yaml:"doh"`
 		Index struct {
 			Root    string `json:"root" yaml:"root"`
 			Headers string `json:"headers" yaml:"headers"`
@@ -70,8 +83,42 @@ type HTTPConfig struct {
 			AuthBasicUserFile string `json:"auth_basic_user_file" yaml:"auth_basic_user_file"`
 			SetHeaders        string `json:"set_headers" yaml:"set_headers"`
 			DumpFailure       bool   `json:"dump_failure" yaml:"dump_failure"`
+			SendProxyProtocol string `json:"send_proxy_protocol" yaml:"send_proxy_protocol"`
+			Upstream          struct {
+				Servers []struct {
+					Url    string `json:"url" yaml:"url"`
+					Weight int    `json:"weight" yaml:"weight"`
+				} `json:"servers" yaml:"servers"`
+				Balance     string `json:"balance" yaml:"balance"`
+				HashCookie  string `json:"hash_cookie" yaml:"hash_cookie"`
+				MaxFails    int    `json:"max_fails" yaml:"max_fails"`
+				FailTimeout int    `json:"fail_timeout" yaml:"fail_timeout"`
+				HealthCheck struct {
+					Path     string `json:"path" yaml:"path"`
+					Interval int    `json:"interval" yaml:"interval"`
+					Timeout  int    `json:"timeout" yaml:"timeout"`
+				} `json:"health_check" yaml:"health_check"`
+			} `json:"upstream" yaml:"upstream"`
+			Cache struct {
+				Enabled      bool   `json:"enabled" yaml:"enabled"`
+				Key          string `json:"key" yaml:"key"`
+				MemorySize   int    `json:"memory_size" yaml:"memory_size"`
+				Dir          string `json:"dir" yaml:"dir"`
+				MaxSize      int64  `json:"max_size" yaml:"max_size"`
+				MaxEntrySize int64  `json:"max_entry_size" yaml:"max_entry_size"`
+			} `json:"cache" yaml:"cache"`
 		} `json:"proxy" yaml:"proxy"`
+		Compress struct {
+			Enabled       bool     `json:"enabled" yaml:"enabled"`
+			Encodings     []string `json:"encodings" yaml:"encodings"` // br, zstd and gzip are encoded on the fly
+			Types         []string `json:"types" yaml:"types"`
+			MinLength     int      `json:"min_length" yaml:"min_length"`
+			Level         int      `json:"level" yaml:"level"`
+			Precompressed bool     `json:"precompressed" yaml:"precompressed"`
+		} `json:"compress" yaml:"compress"`
 	} `json:"web" yaml:"web"`
+	ProxyProtocol        bool     `json:"proxy_protocol" yaml:"proxy_protocol"`
+	ProxyProtocolTrusted []string `json:"proxy_protocol_trusted" yaml:"proxy_protocol_trusted"`
 }
 
 type SocksConfig struct {
@@ -85,17 +132,29 @@ type SocksConfig struct {
 		PreferIpv6       bool   `json:"prefer_ipv6" yaml:"prefer_ipv6"`
 		Log              bool   `json:"log" yaml:"log"`
 	} `json:"forward" yaml:"forward"`
+	ProxyProtocol        bool     `json:"proxy_protocol" yaml:"proxy_protocol"`
+	ProxyProtocolTrusted []string `json:"proxy_protocol_trusted" yaml:"proxy_protocol_trusted"`
 }
 
 type StreamConfig struct {
-	Listen      []string `json:"listen" yaml:"listen"`
-	Keyfile     string   `json:"keyfile" yaml:"keyfile"`
-	Certfile    string   `json:"certfile" yaml:"certfile"`
-	ProxyPass   string   `json:"proxy_pass" yaml:"proxy_pass"`
-	DialTimeout int      `json:"dial_timeout" yaml:"dial_timeout"`
-	Dialer      string   `json:"dialer" yaml:"dialer"`
-	SpeedLimit  int64    `json:"speed_limit" yaml:"speed_limit"`
-	Log         bool     `json:"log" yaml:"log"`
+	Listen               []string `json:"listen" yaml:"listen"`
+	Keyfile              string   `json:"keyfile" yaml:"keyfile"`
+	Certfile             string   `json:"certfile" yaml:"certfile"`
+	ProxyPass            string   `json:"proxy_pass" yaml:"proxy_pass"`
+	DialTimeout          int      `json:"dial_timeout" yaml:"dial_timeout"`
+	IdleTimeout          int      `json:"idle_timeout" yaml:"idle_timeout"`
+	Dialer               string   `json:"dialer" yaml:"dialer"`
+	SpeedLimit           int64    `json:"speed_limit" yaml:"speed_limit"`
+	Log                  bool     `json:"log" yaml:"log"`
+	ProxyProtocol        bool     `json:"proxy_protocol" yaml:"proxy_protocol"`
+	ProxyProtocolTrusted []string `json:"proxy_protocol_trusted" yaml:"proxy_protocol_trusted"`
+	SendProxyProtocol    string   `json:"send_proxy_protocol" yaml:"send_proxy_protocol"`
+	Sniproxy             []struct {
+		ServerName []string `json:"server_name" yaml:"server_name"`
+		Alpn       []string `json:"alpn" yaml:"alpn"`
+		ProxyPass  string   `json:"proxy_pass" yaml:"proxy_pass"`
+		Dialer     string   `json:"dialer" yaml:"dialer"`
+	} `json:"sniproxy" yaml:"sniproxy"`
 }
 
 type TunnelConfig struct {
@@ -109,8 +168,12 @@ type TunnelConfig struct {
 }
 
 type DnsConfig struct {
-	Listen []string `json:"listen" yaml:"listen"`
-	Log    bool     `json:"log" yaml:"log"`
+	Listen     []string          `json:"listen" yaml:"listen"`
+	Policy     string            `json:"policy" yaml:"policy"`
+	Dialer     string            `json:"dialer" yaml:"dialer"`
+	DnsServers map[string]string `json:"dns_servers" yaml:"dns_servers"`
+	FakeIP     string            `json:"fake_ip" yaml:"fake_ip"`
+	Log        bool              `json:"log" yaml:"log"`
 }
 
 type Config struct {
@@ -129,6 +192,16 @@ type Config struct {
 		IdleConnTimeout  int    `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
 		MaxIdleConns     int    `json:"max_idle_conns" yaml:"max_idle_conns"`
 		DisableHttp3     bool   `json:"disable_http3" yaml:"disable_http3"`
+		DnsHosts         string `json:"dns_hosts" yaml:"dns_hosts"`
+		DnsCacheMinTTL   string `json:"dns_cache_min_ttl" yaml:"dns_cache_min_ttl"`
+		DnsNegativeTTL   string `json:"dns_negative_ttl" yaml:"dns_negative_ttl"`
+		DnsServeStale    string `json:"dns_serve_stale" yaml:"dns_serve_stale"`
+		DnsStrategy      string `json:"dns_strategy" yaml:"dns_strategy"`
+		DnsRules         []struct {
+			Domains   []string `json:"domains" yaml:"domains"`
+			Geosite   string   `json:"geosite" yaml:"geosite"`
+			DnsServer string   `json:"dns_server" yaml:"dns_server"`
+		} `json:"dns_rules" yaml:"dns_rules"`
 	} `json:"global" yaml:"global"`
 	Cron []struct {
 		Spec    string `json:"spec" yaml:"spec"`
@@ -211,6 +284,7 @@ func NewConfig(filename string) (*Config, error) {
 		config.Socks = append(config.Socks, c.Socks...)
 		config.Tunnel = append(config.Tunnel, c.Tunnel...)
 		config.Stream = append(config.Stream, c.Stream...)
+		config.Dns = append(config.Dns, c.Dns...)
 	}
 
 	read := func(s string) string {
@@ -229,6 +303,7 @@ func NewConfig(filename string) (*Config, error) {
 		config.Http[i].Forward.Dialer = read(config.Http[i].Forward.Dialer)
 		config.Http[i].Forward.TcpCongestion = read(config.Http[i].Forward.TcpCongestion)
 		for j := range config.Http[i].Web {
+			config.Http[i].Web[j].Doh.Policy = read(config.Http[i].Web[j].Doh.Policy)
 			config.Http[i].Web[j].Index.Headers = read(config.Http[i].Web[j].Index.Headers)
 			config.Http[i].Web[j].Index.Body = read(config.Http[i].Web[j].Index.Body)
 			config.Http[i].Web[j].Proxy.Pass = read(config.Http[i].Web[j].Proxy.Pass)
@@ -240,6 +315,7 @@ func NewConfig(filename string) (*Config, error) {
 		config.Https[i].Forward.Dialer = read(config.Https[i].Forward.Dialer)
 		config.Https[i].Forward.TcpCongestion = read(config.Https[i].Forward.TcpCongestion)
 		for j := range config.Https[i].Web {
+			config.Https[i].Web[j].Doh.Policy = read(config.Https[i].Web[j].Doh.Policy)
 			config.Https[i].Web[j].Index.Headers = read(config.Https[i].Web[j].Index.Headers)
 			config.Https[i].Web[j].Index.Body = read(config.Https[i].Web[j].Index.Body)
 			config.Https[i].Web[j].Proxy.Pass = read(config.Https[i].Web[j].Proxy.Pass)
@@ -250,6 +326,10 @@ func NewConfig(filename string) (*Config, error) {
 		config.Socks[i].Forward.Policy = read(config.Socks[i].Forward.Policy)
 		config.Socks[i].Forward.Dialer = read(config.Socks[i].Forward.Dialer)
 	}
+	for i := range config.Dns {
+		config.Dns[i].Policy = read(config.Dns[i].Policy)
+		config.Dns[i].Dialer = read(config.Dns[i].Dialer)
+	}
 	for i := range config.Tunnel {
 		if len(config.Tunnel[i].Listen) != 1 && config.Tunnel[i].Listen[0] == "" {
 			return nil, fmt.Errorf("invalid tunnel listen=%v", config.Tunnel[i].Listen)
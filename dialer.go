@@ -30,11 +30,78 @@ var (
 	DialerPreferIPv6ContextKey = &DialerContextKey{"dailer-prefer-ipv6"}
 )
 
+// DialerVia returns the name of dialer which d goes through, or "" if d dials directly.
+func DialerVia(d Dialer) string {
+	switch d := d.(type) {
+	case *HTTPDialer:
+		return d.Via
+	case *HTTP2Dialer:
+		return d.Via
+	case *Socks5Dialer:
+		return d.Via
+	case *Socks4Dialer:
+		return d.Via
+	case *SSHDialer:
+		return d.Via
+	}
+	return ""
+}
+
+// DialerChain returns the dialer names which name goes through, e.g. "ssh>socks>https".
+func DialerChain(dialers map[string]Dialer, name string) string {
+	chain := name
+	for i := 0; i < len(dialers); i++ {
+		if name = DialerVia(dialers[name]); name == "" {
+			break
+		}
+		chain += ">" + name
+	}
+	return chain
+}
+
+// DialerCycle returns the dialer names of a cycle reachable from name through via and group members,
+// e.g. [x g x] for x?via=g and g: group://?members=x, or nil if there is none.
+func DialerCycle(dialers map[string]Dialer, name string) []string {
+	var path []string
+	done := make(map[string]bool)
+
+	var walk func(name string) []string
+	walk = func(name string) []string {
+		if i := slices.Index(path, name); i >= 0 {
+			return append(slices.Clone(path[i:]), name)
+		}
+		if done[name] {
+			return nil
+		}
+
+		path = append(path, name)
+		var next []string
+		if via := DialerVia(dialers[name]); via != "" {
+			next = append(next, via)
+		}
+		if g, ok := dialers[name].(*GroupDialer); ok {
+			next = append(next, g.Members...)
+		}
+		for _, n := range next {
+			if cycle := walk(n); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		done[name] = true
+
+		return nil
+	}
+
+	return walk(name)
+}
+
 var _ Dialer = (*LocalDialer)(nil)
 
 type LocalDialer struct {
 	Resolver     *Resolver
 	ResolveCache *lru.TTLCache[string, []netip.Addr]
+	FakeIP       *FakeIPPool
 
 	Interface       string
 	PerferIPv6      bool
@@ -61,7 +128,7 @@ func (d *LocalDialer) DialTLSContext(ctx context.Context, network, address strin
 
 func (d *LocalDialer) dialContext(ctx context.Context, network, address string, tlsConfig *tls.Config) (net.Conn, error) {
 	switch network {
-	case "tcp", "tcp6", "tcp4":
+	case "tcp", "tcp6", "tcp4", "udp", "udp6", "udp4":
 		break
 	default:
 		return (&net.Dialer{}).DialContext(ctx, network, address)
@@ -72,6 +139,10 @@ func (d *LocalDialer) dialContext(ctx context.Context, network, address string,
 		return nil, err
 	}
 
+	if d.FakeIP != nil {
+		host = d.FakeIP.ReverseHost(host)
+	}
+
 	ips, _ := d.ResolveCache.Get(host)
 	if len(ips) == 0 {
 		ips, err = d.Resolver.LookupNetIP(ctx, "ip", host)
@@ -105,7 +176,8 @@ func (d *LocalDialer) dialContext(ctx context.Context, network, address string,
 
 	concurrency := max(d.Concurrency, 1)
 	dial := d.dialParallel
-	if concurrency <= 1 || len(ips) == 1 {
+	// udp dials never fail on unreachable hosts, so racing them makes no sense
+	if concurrency <= 1 || len(ips) == 1 || strings.HasPrefix(network, "udp") {
 		dial = d.dialSerial
 	}
 
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+var _ Dialer = (*GroupDialer)(nil)
+
+// GroupDialer dials through one of its member dialers, members are probed periodically
+// and the unhealthy ones are skipped until they recover.
+type GroupDialer struct {
+	Name          string
+	Members       []string
+	Strategy      string // failover, round_robin, least_latency or consistent_hash
+	CheckAddr     string
+	CheckInterval time.Duration
+	CheckTimeout  time.Duration
+	Dialers       map[string]Dialer
+
+	members []*GroupDialerMember
+	next    atomic.Uint32
+	seed    maphash.Seed
+}
+
+type GroupDialerMember struct {
+	Name   string
+	Dialer Dialer
+
+	down    atomic.Bool
+	latency atomic.Int64
+}
+
+func (d *GroupDialer) Load() error {
+	switch d.Strategy {
+	case "":
+		d.Strategy = "failover"
+	case "failover", "round_robin", "least_latency", "consistent_hash":
+	default:
+		return fmt.Errorf("group dialer %s: unsupported strategy %#v", d.Name, d.Strategy)
+	}
+
+	if len(d.Members) == 0 {
+		return fmt.Errorf("group dialer %s: empty members", d.Name)
+	}
+
+	if cycle := DialerCycle(d.Dialers, d.Name); cycle != nil {
+		return fmt.Errorf("group dialer %s: members cycle detected %s", d.Name, strings.Join(cycle, ">"))
+	}
+
+	for _, name := range d.Members {
+		dialer, ok := d.Dialers[name]
+		if !ok {
+			return fmt.Errorf("group dialer %s: member %#v not exists", d.Name, name)
+		}
+		d.members = append(d.members, &GroupDialerMember{Name: name, Dialer: dialer})
+	}
+
+	d.seed = maphash.MakeSeed()
+
+	if d.CheckAddr != "" {
+		go func() {
+			d.check()
+			for range time.Tick(cmp.Or(d.CheckInterval, 30*time.Second)) {
+				d.check()
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (d *GroupDialer) check() {
+	for _, m := range d.members {
+		go func(m *GroupDialerMember) {
+			ctx, cancel := context.WithTimeout(context.Background(), cmp.Or(d.CheckTimeout, 5*time.Second))
+			defer cancel()
+
+			start := timeNow()
+			conn, err := m.Dialer.DialContext(ctx, "tcp", d.CheckAddr)
+			if err != nil {
+				if !m.down.Swap(true) {
+					log.Warn().Err(err).Str("dialer_group", d.Name).Str("dialer_name", m.Name).Str("check_addr", d.CheckAddr).Msg("group dialer member is down")
+				}
+				return
+			}
+			conn.Close()
+
+			m.latency.Store(int64(timeNow().Sub(start)))
+			if m.down.Swap(false) {
+				log.Info().Str("dialer_group", d.Name).Str("dialer_name", m.Name).Str("check_addr", d.CheckAddr).Dur("latency", time.Duration(m.latency.Load())).Msg("group dialer member is up")
+			}
+		}(m)
+	}
+}
+
+func (d *GroupDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	members := make([]*GroupDialerMember, 0, len(d.members))
+	for _, m := range d.members {
+		if !m.down.Load() {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 {
+		members = append(members, d.members...)
+	}
+
+	switch d.Strategy {
+	case "round_robin":
+		i := int(d.next.Add(1)-1) % len(members)
+		members = append(members[i:], members[:i]...)
+	case "least_latency":
+		slices.SortStableFunc(members, func(a, b *GroupDialerMember) int {
+			return cmp.Compare(a.latency.Load(), b.latency.Load())
+		})
+	case "consistent_hash":
+		// rendezvous hashing on the target host keeps destinations sticky to members
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		slices.SortStableFunc(members, func(a, b *GroupDialerMember) int {
+			return cmp.Compare(maphash.String(d.seed, b.Name+host), maphash.String(d.seed, a.Name+host))
+		})
+	}
+
+	var errs []error
+	for _, m := range members {
+		conn, err := m.Dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		log.Debug().Err(err).Str("dialer_group", d.Name).Str("dialer_name", m.Name).Str("network", network).Str("addr", addr).Msg("group dialer member dial error")
+		errs = append(errs, fmt.Errorf("%s: %w", m.Name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
@@ -32,6 +32,7 @@ type HTTPDialer struct {
 	ClientKey  string
 	ClientCert string
 	Resolve    map[string]string
+	Via        string
 	Dialer     Dialer
 
 	mu        sync.Mutex
@@ -36,6 +36,7 @@ type HTTP2Dialer struct {
 	ClientCert string
 	MaxClients int
 
+	Via    string
 	Dialer Dialer
 
 	mutexes [64]sync.Mutex
@@ -19,6 +19,7 @@ type Socks4Dialer struct {
 	Port     string
 	Socks4A  bool
 	Resolver *Resolver
+	Via      string
 	Dialer   Dialer
 }
 
@@ -100,12 +101,12 @@ func (d *Socks4Dialer) DialContext(ctx context.Context, network, addr string) (n
 	}
 
 	var resp [8]byte
-	_, err = conn.Read(resp[:])
-	if err != nil && err != io.EOF {
+	_, err = io.ReadFull(conn, resp[:])
+	if err != nil {
 		return nil, err
 	}
 
-	if status := Socks4Status(resp[1]); status > 0 {
+	if status := Socks4Status(resp[1]); status != Socks4StatusRequestGranted {
 		return nil, errors.New("proxy: SOCKS4 proxy at " + d.Host + " failed to connect: " + status.String())
 	}
 
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/netip"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -19,11 +20,13 @@ type Socks5Dialer struct {
 	Port     string
 	Socks5H  bool
 	Resolver *Resolver
+	Via      string
 	Dialer   Dialer
 }
 
 func (d *Socks5Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
-	conn, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(d.Host, d.Port))
+	// the control connection is always tcp, udp datagrams go to the relay address in the reply
+	conn, err := d.Dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Host, d.Port))
 	if err != nil {
 		return nil, err
 	}
@@ -103,29 +106,30 @@ func (d *Socks5Dialer) DialContext(ctx context.Context, network, addr string) (n
 	switch network {
 	case "tcp", "tcp6", "tcp4":
 		buf = append(buf, VersionSocks5, SocksCommandConnectTCP, 0 /* reserved */)
+		if ip, err := netip.ParseAddr(host); err == nil {
+			if ip.Is4() {
+				buf = append(buf, Socks5IPv4Address)
+			} else {
+				buf = append(buf, Socks5IPv6Address)
+			}
+			buf = append(buf, ip.AsSlice()...)
+		} else {
+			if len(host) > 255 {
+				return nil, errors.New("proxy: destination hostname too long: " + host)
+			}
+			buf = append(buf, Socks5DomainName)
+			buf = append(buf, byte(len(host)))
+			buf = append(buf, host...)
+		}
+		buf = append(buf, byte(port>>8), byte(port))
 	case "udp", "udp6", "udp4":
-		buf = append(buf, VersionSocks5, SocksCommandConnectUDP, 0 /* reserved */)
+		// the client address is unknown before the relay socket is dialed, and
+		// the destination is carried in each datagram header, see RFC 1928 section 7
+		buf = append(buf, VersionSocks5, SocksCommandConnectUDP, 0 /* reserved */, Socks5IPv4Address, 0, 0, 0, 0, 0, 0)
 	default:
 		return nil, errors.New("proxy: no support for SOCKS5 proxy connections of type " + network)
 	}
 
-	if ip, err := netip.ParseAddr(host); err == nil {
-		if ip.Is4() {
-			buf = append(buf, Socks5IPv4Address)
-		} else {
-			buf = append(buf, Socks5IPv6Address)
-		}
-		buf = append(buf, ip.AsSlice()...)
-	} else {
-		if len(host) > 255 {
-			return nil, errors.New("proxy: destination hostname too long: " + host)
-		}
-		buf = append(buf, Socks5DomainName)
-		buf = append(buf, byte(len(host)))
-		buf = append(buf, host...)
-	}
-	buf = append(buf, byte(port>>8), byte(port))
-
 	if deadline, ok := ctx.Deadline(); ok {
 		conn.SetDeadline(deadline)
 		defer conn.SetDeadline(time.Time{})
@@ -143,36 +147,173 @@ func (d *Socks5Dialer) DialContext(ctx context.Context, network, addr string) (n
 		return nil, errors.New("proxy: SOCKS5 proxy at " + d.Host + " failed to connect: " + status.String())
 	}
 
-	bytesToDiscard := 0
-	switch buf[3] {
+	addrType := buf[3]
+	addrLen := 0
+	switch addrType {
 	case Socks5IPv4Address:
-		bytesToDiscard = net.IPv4len
+		addrLen = net.IPv4len
 	case Socks5IPv6Address:
-		bytesToDiscard = net.IPv6len
+		addrLen = net.IPv6len
 	case Socks5DomainName:
 		_, err := io.ReadFull(conn, buf[:1])
 		if err != nil {
 			return nil, errors.New("proxy: failed to read domain length from SOCKS5 proxy at " + d.Host + ": " + err.Error())
 		}
-		bytesToDiscard = int(buf[0])
+		addrLen = int(buf[0])
 	default:
-		return nil, errors.New("proxy: got unknown address type " + strconv.Itoa(int(buf[3])) + " from SOCKS5 proxy at " + d.Host)
+		return nil, errors.New("proxy: got unknown address type " + strconv.Itoa(int(addrType)) + " from SOCKS5 proxy at " + d.Host)
 	}
 
-	if cap(buf) < bytesToDiscard {
-		buf = make([]byte, bytesToDiscard)
+	if cap(buf) < addrLen+2 {
+		buf = make([]byte, addrLen+2)
 	} else {
-		buf = buf[:bytesToDiscard]
+		buf = buf[:addrLen+2]
 	}
-	if _, err := io.ReadFull(conn, buf); err != nil {
+	if _, err := io.ReadFull(conn, buf[:addrLen]); err != nil {
 		return nil, errors.New("proxy: failed to read address from SOCKS5 proxy at " + d.Host + ": " + err.Error())
 	}
 
-	// Also need to discard the port number
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+	if _, err := io.ReadFull(conn, buf[addrLen:]); err != nil {
 		return nil, errors.New("proxy: failed to read port from SOCKS5 proxy at " + d.Host + ": " + err.Error())
 	}
 
+	if network == "tcp" || network == "tcp4" || network == "tcp6" {
+		closeConn = nil
+		return conn, nil
+	}
+
+	// udp associate, dial the relay address from the reply
+	relayHost := string(buf[:addrLen])
+	if addrType != Socks5DomainName {
+		ip, _ := netip.AddrFromSlice(buf[:addrLen])
+		relayHost = ip.Unmap().String()
+		// an unspecified address means the relay shares the address of the proxy
+		if ip.IsUnspecified() {
+			relayHost = d.Host
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				relayHost = addr.AddrPort().Addr().Unmap().String()
+			}
+		}
+	}
+	relayPort := strconv.Itoa(int(buf[addrLen])<<8 | int(buf[addrLen+1]))
+
+	pconn, err := d.Dialer.DialContext(ctx, "udp", net.JoinHostPort(relayHost, relayPort))
+	if err != nil {
+		return nil, errors.New("proxy: failed to dial udp relay of SOCKS5 proxy at " + d.Host + ": " + err.Error())
+	}
+
+	uconn := &Socks5UDPConn{
+		Conn:    pconn,
+		Control: conn,
+		Header:  AppendSocks5Address([]byte{0, 0, 0}, host, port),
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		uconn.Addr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port)))
+	}
+
+	// the relay is torn down by the proxy once the control connection closes
+	go func() {
+		io.Copy(io.Discard, conn)
+		pconn.Close()
+	}()
+
 	closeConn = nil
-	return conn, nil
+	return uconn, nil
+}
+
+var _ net.Conn = (*Socks5UDPConn)(nil)
+var _ net.PacketConn = (*Socks5UDPConn)(nil)
+
+// Socks5UDPConn wraps the udp relay socket of a SOCKS5 UDP ASSOCIATE, Write prepends Header to
+// each datagram and Read strips the header of replies.
+type Socks5UDPConn struct {
+	net.Conn
+	Control net.Conn
+	Header  []byte
+	Addr    *net.UDPAddr
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (c *Socks5UDPConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *Socks5UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.buf == nil {
+		// a datagram never exceeds 64KB, the header included
+		c.buf = make([]byte, 65536)
+	}
+
+	for {
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// drop fragmented or malformed datagrams
+		if n < 4 || c.buf[2] != 0 {
+			continue
+		}
+		host, port, data, err := ParseSocks5Address(c.buf[3:n])
+		if err != nil {
+			continue
+		}
+		var addr net.Addr = Socks5DomainAddr{host, port}
+		if ip, err := netip.ParseAddr(host); err == nil {
+			addr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port)))
+		}
+		return copy(b, data), addr, nil
+	}
+}
+
+func (c *Socks5UDPConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(append(c.Header[:len(c.Header):len(c.Header)], b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Socks5UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	port, _ := strconv.Atoi(portStr)
+	if _, err := c.Conn.Write(append(AppendSocks5Address([]byte{0, 0, 0}, host, port), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Socks5UDPConn) RemoteAddr() net.Addr {
+	if c.Addr != nil {
+		return c.Addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Socks5UDPConn) Close() error {
+	c.Control.Close()
+	return c.Conn.Close()
+}
+
+var _ net.Addr = Socks5DomainAddr{}
+
+// Socks5DomainAddr is the source of a datagram which the SOCKS5 proxy reports by domain name.
+type Socks5DomainAddr struct {
+	Host string
+	Port int
+}
+
+func (a Socks5DomainAddr) Network() string {
+	return "udp"
+}
+
+func (a Socks5DomainAddr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSocks5DialerUDP(t *testing.T) {
+	filename := t.TempDir() + "/hosts"
+	if err := os.WriteFile(filename, []byte("127.0.0.1 echo.test\n"), 0644); err != nil {
+		t.Fatalf("write hosts error: %+v", err)
+	}
+
+	// the upstream socks5 proxy resolves echo.test from its hosts
+	upstream := newSocksTestHandler(t, SocksConfig{}, nil)
+	upstream.LocalDialer.Resolver.Hosts = &FileLoader[map[string][]netip.Addr]{Filename: filename, Unmarshal: HostsUnmarshal}
+	ln := newSocksTestServer(t, upstream)
+
+	echo1, echo2 := newSocksTestEchoServer(t), newSocksTestEchoServer(t)
+	port1 := echo1.LocalAddr().(*net.UDPAddr).Port
+	port2 := echo2.LocalAddr().(*net.UDPAddr).Port
+
+	d := &Socks5Dialer{
+		Host:    "127.0.0.1",
+		Port:    strconv.Itoa(ln.Addr().(*net.TCPAddr).Port),
+		Socks5H: true,
+		Dialer:  streamTestDialer((&net.Dialer{}).DialContext),
+	}
+
+	conn, err := d.DialContext(context.Background(), "udp", net.JoinHostPort("echo.test", strconv.Itoa(port1)))
+	if err != nil {
+		t.Fatalf("Socks5Dialer.DialContext(udp) error: %+v", err)
+	}
+	defer conn.Close()
+
+	pconn := conn.(*Socks5UDPConn)
+	b := make([]byte, 1500)
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Socks5UDPConn.Write error: %+v", err)
+	}
+	n, addr, err := pconn.ReadFrom(b)
+	if err != nil || string(b[:n]) != "echo:hello" || addr.String() != echo1.LocalAddr().String() {
+		t.Errorf("Socks5UDPConn.ReadFrom must return echo:hello from %s, not %q from %v err=%+v", echo1.LocalAddr(), b[:n], addr, err)
+	}
+
+	if _, err := pconn.WriteTo([]byte("world"), echo2.LocalAddr()); err != nil {
+		t.Fatalf("Socks5UDPConn.WriteTo error: %+v", err)
+	}
+	n, addr, err = pconn.ReadFrom(b)
+	if err != nil || string(b[:n]) != "echo:world" || addr.String() != echo2.LocalAddr().String() {
+		t.Errorf("Socks5UDPConn.ReadFrom must return echo:world from %s, not %q from %v err=%+v", echo2.LocalAddr(), b[:n], addr, err)
+	}
+
+	// a relay dialing through the socks5 dialer replies with the real source, not the upstream relay
+	var config SocksConfig
+	config.Forward.Dialer = `{{if true}}upstream{{end}}`
+	h := newSocksTestHandler(t, config, nil)
+	h.Dialers = map[string]Dialer{"upstream": d}
+	relay := newSocksTestServer(t, h)
+
+	client, err := (&Socks5Dialer{
+		Host:   "127.0.0.1",
+		Port:   strconv.Itoa(relay.Addr().(*net.TCPAddr).Port),
+		Dialer: streamTestDialer((&net.Dialer{}).DialContext),
+	}).DialContext(context.Background(), "udp", net.JoinHostPort("echo.test", strconv.Itoa(port2)))
+	if err != nil {
+		t.Fatalf("Socks5Dialer.DialContext(udp) error: %+v", err)
+	}
+	defer client.Close()
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("chained"))
+	n, addr, err = client.(*Socks5UDPConn).ReadFrom(b)
+	if err != nil || string(b[:n]) != "echo:chained" || addr.String() != echo2.LocalAddr().String() {
+		t.Errorf("chained Socks5UDPConn.ReadFrom must return echo:chained from %s, not %q from %v err=%+v", echo2.LocalAddr(), b[:n], addr, err)
+	}
+}
+
+func TestSocks5DialerUDPUnspecifiedRelay(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenUDP error: %+v", err)
+	}
+	defer relay.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %+v", err)
+	}
+	defer ln.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 10)
+		io.ReadFull(conn, b[:3])
+		conn.Write([]byte{0x05, 0x00})
+		io.ReadFull(conn, b[:10])
+		// the relay is bound to all interfaces, the client must use the proxy address instead
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	d := &Socks5Dialer{
+		Host:   "127.0.0.1",
+		Port:   strconv.Itoa(ln.Addr().(*net.TCPAddr).Port),
+		Dialer: streamTestDialer((&net.Dialer{}).DialContext),
+	}
+	conn, err := d.DialContext(context.Background(), "udp", "1.2.3.4:53")
+	if err != nil {
+		t.Fatalf("Socks5Dialer.DialContext(udp) error: %+v", err)
+	}
+	pconn := conn.(*Socks5UDPConn)
+
+	if addr := conn.RemoteAddr().String(); addr != "1.2.3.4:53" {
+		t.Errorf("Socks5UDPConn.RemoteAddr() must return the destination 1.2.3.4:53, not %s", addr)
+	}
+
+	conn.Write([]byte("ping"))
+	pconn.WriteTo([]byte("pong"), Socks5DomainAddr{"example.org", 53})
+
+	b := make([]byte, 1500)
+	relay.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range [][]byte{
+		append(AppendSocks5Address([]byte{0, 0, 0}, "1.2.3.4", 53), "ping"...),
+		append(AppendSocks5Address([]byte{0, 0, 0}, "example.org", 53), "pong"...),
+	} {
+		n, caddr, err := relay.ReadFromUDP(b)
+		if err != nil || !bytes.Equal(b[:n], want) {
+			t.Fatalf("udp relay must receive %q, not %q err=%+v", want, b[:n], err)
+		}
+
+		// fragmented replies are dropped
+		relay.WriteToUDP(append([]byte{0, 0, 1}, want[3:]...), caddr)
+		relay.WriteToUDP(append(want[:len(want)-4:len(want)-4], "echo"...), caddr)
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, addr, err := pconn.ReadFrom(b)
+		if host, _, _, _ := ParseSocks5Address(want[3:]); err != nil || string(b[:n]) != "echo" || addr.String() != net.JoinHostPort(host, "53") {
+			t.Errorf("Socks5UDPConn.ReadFrom must return echo from %s:53, not %q from %v err=%+v", host, b[:n], addr, err)
+		}
+	}
+
+	// closing the udp conn closes the control connection
+	conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Socks5UDPConn.Close must close the control connection")
+	}
+}
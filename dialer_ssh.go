@@ -26,6 +26,7 @@ type SSHDialer struct {
 	UserKnownHostsFile    string
 	MaxClients            int
 	Timeout               time.Duration
+	Via                   string
 	Dialer                Dialer
 
 	mutexes [64]sync.Mutex
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDialerCycle(t *testing.T) {
+	cases := []struct {
+		Name    string
+		Dialers map[string]Dialer
+		Cycle   string
+	}{
+		{
+			"a",
+			map[string]Dialer{
+				"a": &HTTPDialer{Via: "b"},
+				"b": &Socks5Dialer{},
+			},
+			"",
+		},
+		{
+			"a",
+			map[string]Dialer{
+				"a": &HTTPDialer{Via: "b"},
+				"b": &SSHDialer{Via: "a"},
+			},
+			"a>b>a",
+		},
+		{
+			"g",
+			map[string]Dialer{
+				"g": &GroupDialer{Name: "g", Members: []string{"g"}},
+			},
+			"g>g",
+		},
+		{
+			"ga",
+			map[string]Dialer{
+				"ga": &GroupDialer{Name: "ga", Members: []string{"x", "gb"}},
+				"gb": &GroupDialer{Name: "gb", Members: []string{"y", "ga"}},
+				"x":  &HTTPDialer{},
+				"y":  &HTTPDialer{},
+			},
+			"ga>gb>ga",
+		},
+		{
+			"x",
+			map[string]Dialer{
+				"x": &HTTP2Dialer{Via: "g"},
+				"g": &GroupDialer{Name: "g", Members: []string{"x"}},
+			},
+			"x>g>x",
+		},
+		{
+			"y",
+			map[string]Dialer{
+				"y": &Socks4Dialer{Via: "x"},
+				"x": &HTTPDialer{Via: "g"},
+				"g": &GroupDialer{Name: "g", Members: []string{"z", "x"}},
+				"z": &HTTPDialer{},
+			},
+			"x>g>x",
+		},
+		{
+			"g",
+			map[string]Dialer{
+				"g": &GroupDialer{Name: "g", Members: []string{"x", "y"}},
+				"x": &HTTPDialer{Via: "y"},
+				"y": &Socks5Dialer{},
+			},
+			"",
+		},
+	}
+
+	for _, c := range cases {
+		if got := strings.Join(DialerCycle(c.Dialers, c.Name), ">"); got != c.Cycle {
+			t.Errorf("DialerCycle(%#v) must return %#v, not %#v", c.Name, c.Cycle, got)
+		}
+	}
+}
+
+func TestGroupDialerLoadCycle(t *testing.T) {
+	dialers := map[string]Dialer{
+		"x": &HTTPDialer{},
+	}
+	ga := &GroupDialer{Name: "ga", Members: []string{"x", "gb"}, Dialers: dialers}
+	gb := &GroupDialer{Name: "gb", Members: []string{"ga"}, Dialers: dialers}
+	dialers["ga"], dialers["gb"] = ga, gb
+
+	if err := ga.Load(); err == nil || !strings.Contains(err.Error(), "ga>gb>ga") {
+		t.Errorf("GroupDialer.Load must return cycle error, not %+v", err)
+	}
+}
@@ -3,7 +3,9 @@ module liner
 go 1.24
 
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/go-task/slim-sprig/v3 v3.0.0
+	github.com/klauspost/compress v1.18.0
 	github.com/libp2p/go-yamux/v4 v4.0.2
 	github.com/mileusna/useragent v1.3.5
 	github.com/nathanaelle/password/v2 v2.0.1
@@ -2,17 +2,28 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/phuslu/fastdns"
 	"github.com/phuslu/log"
+	"github.com/quic-go/quic-go"
+	"github.com/valyala/bytebufferpool"
 )
 
 type DnsRequest struct {
 	RemoteAddr string
 	RemoteIP   string
 	ServerAddr string
+	Domain     string
+	QType      string
 	Message    *fastdns.Message
 	TraceID    log.XID
 }
@@ -20,6 +31,9 @@ type DnsRequest struct {
 type DnsHandler struct {
 	Config    DnsConfig
 	Logger    log.Logger
+	Resolver  *Resolver
+	Resolvers map[string]*Resolver
+	FakeIP    *FakeIPPool
 	Functions template.FuncMap
 
 	policy *template.Template
@@ -27,9 +41,73 @@ type DnsHandler struct {
 }
 
 func (h *DnsHandler) Load() error {
+	var err error
+
+	if h.Resolver == nil {
+		return errors.New("dns handler: empty resolver")
+	}
+
+	h.Config.Policy = strings.TrimSpace(h.Config.Policy)
+	if s := h.Config.Policy; strings.Contains(s, "{{") {
+		if h.policy, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	}
+
+	h.Config.Dialer = strings.TrimSpace(h.Config.Dialer)
+	if s := h.Config.Dialer; strings.Contains(s, "{{") {
+		if h.dialer, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	} else if s != "" {
+		if _, ok := h.Resolvers[s]; !ok {
+			return fmt.Errorf("dns handler: dns_server %#v not exists", s)
+		}
+	}
+
 	return nil
 }
 
+// ServePacketConn serves dns queries over udp, each query is handled in a standalone goroutine.
+func (h *DnsHandler) ServePacketConn(ctx context.Context, conn net.PacketConn) {
+	defer conn.Close()
+
+	for {
+		var b [4096]byte
+		n, addr, err := conn.ReadFrom(b[:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Error().Err(err).Str("server_addr", conn.LocalAddr().String()).Msg("dns read packet error")
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		msg := fastdns.AcquireMessage()
+		if err := fastdns.ParseMessage(msg, b[:n], true); err != nil {
+			log.Debug().Err(err).Str("server_addr", conn.LocalAddr().String()).Stringer("remote_addr", addr).Msg("dns parse packet error")
+			fastdns.ReleaseMessage(msg)
+			continue
+		}
+
+		go func(addr net.Addr, msg *fastdns.Message) {
+			defer fastdns.ReleaseMessage(msg)
+
+			req := DnsRequest{
+				RemoteAddr: addr.String(),
+				ServerAddr: conn.LocalAddr().String(),
+				Message:    msg,
+				TraceID:    log.NewXID(),
+			}
+			req.RemoteIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+
+			h.ServeDNS(ctx, &DnsPacketWriter{Conn: conn, Addr: addr}, &req)
+		}(addr, msg)
+	}
+}
+
+// ServeConn serves length-prefixed dns queries over a stream connection, see RFC 7766.
 func (h *DnsHandler) ServeConn(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
@@ -38,16 +116,339 @@ func (h *DnsHandler) ServeConn(ctx context.Context, conn net.Conn) {
 	req.RemoteIP, _, _ = net.SplitHostPort(req.RemoteAddr)
 	req.ServerAddr = conn.LocalAddr().String()
 	req.Message = fastdns.AcquireMessage()
-	req.TraceID = log.NewXID()
+	defer fastdns.ReleaseMessage(req.Message)
+
+	rw := &DnsStreamWriter{Conn: conn}
+
+	var b [2]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			if !errors.Is(err, io.EOF) && !IsTimeout(err) {
+				log.Debug().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("dns read length error")
+			}
+			return
+		}
+
+		length := int(binary.BigEndian.Uint16(b[:]))
+		if cap(req.Message.Raw) < length {
+			req.Message.Raw = make([]byte, length)
+		}
+		req.Message.Raw = req.Message.Raw[:length]
+
+		if _, err := io.ReadFull(conn, req.Message.Raw); err != nil {
+			log.Debug().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("dns read message error")
+			return
+		}
+
+		if err := fastdns.ParseMessage(req.Message, req.Message.Raw, false); err != nil {
+			log.Debug().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("dns parse message error")
+			return
+		}
+
+		req.TraceID = log.NewXID()
+
+		h.ServeDNS(ctx, rw, &req)
+	}
+}
+
+// ServeQuicConn serves dns queries over quic streams, each stream carries a single query, see RFC 9250.
+func (h *DnsHandler) ServeQuicConn(ctx context.Context, conn quic.Connection) {
+	defer conn.CloseWithError(0, "")
 
 	for {
-		_, err := conn.Read(req.Message.Raw)
+		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
-			continue
+			return
+		}
+
+		go func(stream quic.Stream) {
+			defer stream.Close()
+
+			stream.SetReadDeadline(time.Now().Add(30 * time.Second))
+
+			var b [2]byte
+			if _, err := io.ReadFull(stream, b[:]); err != nil {
+				log.Debug().Err(err).Stringer("server_addr", conn.LocalAddr()).Stringer("remote_addr", conn.RemoteAddr()).Msg("dns read quic length error")
+				return
+			}
+
+			msg := fastdns.AcquireMessage()
+			defer fastdns.ReleaseMessage(msg)
+
+			length := int(binary.BigEndian.Uint16(b[:]))
+			if cap(msg.Raw) < length {
+				msg.Raw = make([]byte, length)
+			}
+			msg.Raw = msg.Raw[:length]
+
+			if _, err := io.ReadFull(stream, msg.Raw); err != nil {
+				log.Debug().Err(err).Stringer("server_addr", conn.LocalAddr()).Stringer("remote_addr", conn.RemoteAddr()).Msg("dns read quic message error")
+				return
+			}
+
+			if err := fastdns.ParseMessage(msg, msg.Raw, false); err != nil {
+				log.Debug().Err(err).Stringer("server_addr", conn.LocalAddr()).Stringer("remote_addr", conn.RemoteAddr()).Msg("dns parse quic message error")
+				return
+			}
+
+			req := DnsRequest{
+				RemoteAddr: conn.RemoteAddr().String(),
+				ServerAddr: conn.LocalAddr().String(),
+				Message:    msg,
+				TraceID:    log.NewXID(),
+			}
+			req.RemoteIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+
+			h.ServeDNS(ctx, &DnsQuicWriter{Conn: conn, Stream: stream}, &req)
+		}(stream)
+	}
+}
+
+func (h *DnsHandler) ServeDNS(ctx context.Context, rw fastdns.ResponseWriter, req *DnsRequest) {
+	msg := req.Message
+	req.Domain, req.QType = string(msg.Domain), msg.Question.Type.String()
+
+	log.Debug().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("dns_name", req.Domain).Str("dns_type", req.QType).Msg("dns request")
+
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+
+	var policyName = h.Config.Policy
+	if h.policy != nil {
+		bb.Reset()
+		err := h.policy.Execute(bb, struct {
+			Request    DnsRequest
+			ServerAddr string
+		}{*req, req.ServerAddr})
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("dns_policy", h.Config.Policy).Msg("execute dns_policy error")
+			WriteDnsError(rw, msg, fastdns.RcodeServFail)
+			return
 		}
-		err = fastdns.ParseMessage(req.Message, req.Message.Raw, false)
+		policyName = strings.TrimSpace(bb.String())
+		log.Debug().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Interface("request", req).Str("dns_policy_name", policyName).Msg("execute dns_policy ok")
+	}
+
+	var dialerName = h.Config.Dialer
+	if h.dialer != nil {
+		bb.Reset()
+		err := h.dialer.Execute(bb, struct {
+			Request    DnsRequest
+			ServerAddr string
+		}{*req, req.ServerAddr})
 		if err != nil {
-			continue
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("dns_dialer", h.Config.Dialer).Msg("execute dns_dialer error")
+			WriteDnsError(rw, msg, fastdns.RcodeServFail)
+			return
 		}
+		dialerName = strings.TrimSpace(bb.String())
 	}
+
+	resolver := h.Resolver
+	if dialerName != "" {
+		r, ok := h.Resolvers[dialerName]
+		if !ok {
+			log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("dns_dialer", h.Config.Dialer).Str("dns_dialer_name", dialerName).Msg("dns dialer not exists")
+			WriteDnsError(rw, msg, fastdns.RcodeServFail)
+			return
+		}
+		resolver = r
+	}
+
+	var rcode = fastdns.RcodeNoError
+	var ips []netip.Addr
+	var err error
+
+	if policyName == "" && h.FakeIP != nil {
+		policyName = "fake_ip"
+	}
+
+	switch policyName {
+	case "reject", "deny":
+		rcode = fastdns.RcodeRefused
+		WriteDnsError(rw, msg, rcode)
+	case "nxdomain":
+		rcode = fastdns.RcodeNXDomain
+		WriteDnsError(rw, msg, rcode)
+	case "fake_ip":
+		if h.FakeIP == nil {
+			err = errors.New("dns fake_ip is not configured")
+			rcode = fastdns.RcodeServFail
+			WriteDnsError(rw, msg, rcode)
+			break
+		}
+		switch msg.Question.Type {
+		case fastdns.TypeA, fastdns.TypeAAAA:
+			if ip := h.FakeIP.Lookup(req.Domain); ip.Is4() == (msg.Question.Type == fastdns.TypeA) {
+				ips = append(ips, ip)
+			}
+		}
+		// a short ttl keeps clients from holding recycled addresses
+		WriteDnsHosts(rw, msg, 1, ips)
+	case "", "proxy_pass":
+		switch msg.Question.Type {
+		case fastdns.TypeA, fastdns.TypeAAAA:
+			var ttl uint32
+			ips, ttl, err = h.lookup(ctx, resolver, req.Domain, msg.Question.Type)
+			if err != nil {
+				rcode = fastdns.RcodeServFail
+				WriteDnsError(rw, msg, rcode)
+				break
+			}
+			WriteDnsHosts(rw, msg, ttl, ips)
+		default:
+			err = h.exchange(ctx, resolver, rw, msg)
+			if err != nil {
+				rcode = fastdns.RcodeServFail
+				WriteDnsError(rw, msg, rcode)
+			}
+		}
+	default:
+		// static answers, e.g. "127.0.0.1 ::1"
+		for _, s := range strings.Fields(policyName) {
+			ip, e := netip.ParseAddr(s)
+			if e != nil {
+				err = fmt.Errorf("invalid dns_policy answer %#v: %w", s, e)
+				break
+			}
+			if (ip.Is4() && msg.Question.Type == fastdns.TypeA) || (ip.Is6() && msg.Question.Type == fastdns.TypeAAAA) {
+				ips = append(ips, ip)
+			}
+		}
+		if err != nil {
+			rcode = fastdns.RcodeServFail
+			WriteDnsError(rw, msg, rcode)
+			break
+		}
+		WriteDnsHosts(rw, msg, 60, ips)
+	}
+
+	if err != nil {
+		log.Error().Err(err).Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("dns_name", req.Domain).Str("dns_type", req.QType).Str("dns_policy_name", policyName).Str("dns_dialer_name", dialerName).Msg("dns resolve error")
+	}
+
+	if h.Config.Log {
+		h.Logger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("dns_name", req.Domain).Str("dns_type", req.QType).Str("dns_policy_name", policyName).Str("dns_dialer_name", dialerName).Stringer("dns_rcode", rcode).Any("dns_answers", ips).Msg("dns request end")
+	}
+}
+
+func (h *DnsHandler) lookup(ctx context.Context, resolver *Resolver, domain string, qtype fastdns.Type) ([]netip.Addr, uint32, error) {
+	// always lookup both families so that the shared cache entry stays complete
+	ips, ttl, err := resolver.LookupNetIPTTL(ctx, "ip", domain)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	answers := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		if ip.Is4() == (qtype == fastdns.TypeA) {
+			answers = append(answers, ip)
+		}
+	}
+
+	return answers, ttl, nil
+}
+
+func (h *DnsHandler) exchange(ctx context.Context, resolver *Resolver, rw fastdns.ResponseWriter, msg *fastdns.Message) error {
+	resp := fastdns.AcquireMessage()
+	defer fastdns.ReleaseMessage(resp)
+
+	err := resolver.Exchange(ctx, msg, resp)
+	if err != nil {
+		return err
+	}
+
+	// keep the client transaction id, upstream dialers may rewrite it
+	binary.BigEndian.PutUint16(resp.Raw, msg.Header.ID)
+
+	_, err = rw.Write(resp.Raw)
+	return err
+}
+
+// WriteDnsError replies an error rcode but keeps the question section, which fastdns.Error strips.
+func WriteDnsError(rw fastdns.ResponseWriter, msg *fastdns.Message, rcode fastdns.Rcode) (int, error) {
+	msg.SetResponseHeader(fastdns.RcodeNoError, 0)
+	msg.Raw[3] = 0x80 | byte(rcode) // RA=1
+	return rw.Write(msg.Raw)
+}
+
+// WriteDnsHosts replies A/AAAA records with the RA flag set.
+func WriteDnsHosts(rw fastdns.ResponseWriter, msg *fastdns.Message, ttl uint32, ips []netip.Addr) (int, error) {
+	msg.SetResponseHeader(fastdns.RcodeNoError, uint16(len(ips)))
+	msg.Raw[3] |= 0x80 // RA=1
+	msg.Raw = fastdns.AppendHOSTRecord(msg.Raw, msg, ttl, ips)
+	return rw.Write(msg.Raw)
+}
+
+var _ fastdns.ResponseWriter = (*DnsPacketWriter)(nil)
+
+type DnsPacketWriter struct {
+	Conn net.PacketConn
+	Addr net.Addr
+}
+
+func (rw *DnsPacketWriter) RemoteAddr() netip.AddrPort {
+	return AddrPortOf(rw.Addr)
+}
+
+func (rw *DnsPacketWriter) LocalAddr() netip.AddrPort {
+	return AddrPortOf(rw.Conn.LocalAddr())
+}
+
+func (rw *DnsPacketWriter) Write(p []byte) (int, error) {
+	return rw.Conn.WriteTo(p, rw.Addr)
+}
+
+var _ fastdns.ResponseWriter = (*DnsStreamWriter)(nil)
+
+type DnsStreamWriter struct {
+	Conn net.Conn
+}
+
+func (rw *DnsStreamWriter) RemoteAddr() netip.AddrPort {
+	return AddrPortOf(rw.Conn.RemoteAddr())
+}
+
+func (rw *DnsStreamWriter) LocalAddr() netip.AddrPort {
+	return AddrPortOf(rw.Conn.LocalAddr())
+}
+
+func (rw *DnsStreamWriter) Write(p []byte) (int, error) {
+	b := make([]byte, 2, 2+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	return rw.Conn.Write(append(b, p...))
+}
+
+func AddrPortOf(addr net.Addr) netip.AddrPort {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.AddrPort()
+	case *net.TCPAddr:
+		return addr.AddrPort()
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
+
+var _ fastdns.ResponseWriter = (*DnsQuicWriter)(nil)
+
+type DnsQuicWriter struct {
+	Conn   quic.Connection
+	Stream quic.Stream
+}
+
+func (rw *DnsQuicWriter) RemoteAddr() netip.AddrPort {
+	return AddrPortOf(rw.Conn.RemoteAddr())
+}
+
+func (rw *DnsQuicWriter) LocalAddr() netip.AddrPort {
+	return AddrPortOf(rw.Conn.LocalAddr())
+}
+
+func (rw *DnsQuicWriter) Write(p []byte) (int, error) {
+	b := make([]byte, 2, 2+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	return rw.Stream.Write(append(b, p...))
 }
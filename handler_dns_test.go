@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/phuslu/fastdns"
+	"github.com/phuslu/lru"
+)
+
+func newDnsTestHandler(t *testing.T) *DnsHandler {
+	h := &DnsHandler{
+		Config: DnsConfig{
+			Policy: `{{if eq .Request.Domain "blocked.example.org"}}nxdomain{{else if eq .Request.Domain "static.example.org"}}10.0.0.1 ::1{{end}}`,
+			Dialer: `{{if eq .Request.Domain "other.example.org"}}other{{end}}`,
+		},
+		Resolver: &Resolver{
+			Client:        newResolverTestClient(t, &resolverTestHandler{IP: netip.MustParseAddr("2.2.2.2")}),
+			CacheDuration: 10 * time.Minute,
+			LRUCache:      lru.NewTTLCache[string, []netip.Addr](1024),
+		},
+		Resolvers: map[string]*Resolver{
+			"other": {Client: newResolverTestClient(t, &resolverTestHandler{IP: netip.MustParseAddr("3.3.3.3")})},
+		},
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("DnsHandler.Load error: %+v", err)
+	}
+	return h
+}
+
+// dnsTestAnswer parses a dns response into its rcode, answers and ttl of the last answer.
+func dnsTestAnswer(t *testing.T, data []byte) (fastdns.Rcode, string, uint32) {
+	resp := fastdns.AcquireMessage()
+	defer fastdns.ReleaseMessage(resp)
+
+	if err := fastdns.ParseMessage(resp, data, true); err != nil {
+		t.Fatalf("fastdns.ParseMessage error: %+v", err)
+	}
+
+	var ips []netip.Addr
+	var ttl uint32
+	for rr := range resp.Records {
+		switch rr.Type {
+		case fastdns.TypeA:
+			ips = append(ips, netip.AddrFrom4(*(*[4]byte)(rr.Data)))
+		case fastdns.TypeAAAA:
+			ips = append(ips, netip.AddrFrom16(*(*[16]byte)(rr.Data)))
+		}
+		ttl = rr.TTL
+	}
+
+	return resp.Header.Flags.Rcode(), fmt.Sprint(ips), ttl
+}
+
+func TestDnsHandler(t *testing.T) {
+	h := newDnsTestHandler(t)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket error: %+v", err)
+	}
+	go h.ServePacketConn(context.Background(), pc)
+	defer pc.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %+v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go h.ServeConn(context.Background(), conn)
+		}
+	}()
+
+	cases := []struct {
+		Domain  string
+		Type    fastdns.Type
+		Rcode   fastdns.Rcode
+		Answers string
+		TTL     uint32
+	}{
+		{"blocked.example.org", fastdns.TypeA, fastdns.RcodeNXDomain, "[]", 0},
+		{"static.example.org", fastdns.TypeA, fastdns.RcodeNoError, "[10.0.0.1]", 60},
+		{"static.example.org", fastdns.TypeAAAA, fastdns.RcodeNoError, "[::1]", 60},
+		{"other.example.org", fastdns.TypeA, fastdns.RcodeNoError, "[3.3.3.3]", 60},
+		// the record ttl is kept, not raised to the cache duration
+		{"www.example.org", fastdns.TypeA, fastdns.RcodeNoError, "[2.2.2.2]", 60},
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		addr := pc.LocalAddr().String()
+		if network == "tcp" {
+			addr = ln.Addr().String()
+		}
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatalf("net.Dial(%s) error: %+v", network, err)
+		}
+
+		for _, c := range cases {
+			req := fastdns.AcquireMessage()
+			req.SetRequestQuestion(c.Domain, c.Type, fastdns.ClassINET)
+			data := req.Raw
+			if network == "tcp" {
+				data = binary.BigEndian.AppendUint16(nil, uint16(len(req.Raw)))
+				data = append(data, req.Raw...)
+			}
+
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			_, err := conn.Write(data)
+			fastdns.ReleaseMessage(req)
+			if err != nil {
+				t.Fatalf("dns %s write error: %+v", network, err)
+			}
+
+			b := make([]byte, 1500)
+			if network == "tcp" {
+				if _, err = io.ReadFull(conn, b[:2]); err == nil {
+					b = b[:binary.BigEndian.Uint16(b)]
+					_, err = io.ReadFull(conn, b)
+				}
+			} else {
+				var n int
+				n, err = conn.Read(b)
+				b = b[:n]
+			}
+			if err != nil {
+				t.Fatalf("dns %s read error: %+v", network, err)
+			}
+
+			rcode, answers, ttl := dnsTestAnswer(t, b)
+			// the cached answer may be a second older on the second network
+			if rcode != c.Rcode || answers != c.Answers || ttl > c.TTL || ttl+2 < c.TTL {
+				t.Errorf("dns %s query(%s, %s) must return %s %s ttl=%d, not %s %s ttl=%d", network, c.Domain, c.Type, c.Rcode, c.Answers, c.TTL, rcode, answers, ttl)
+			}
+		}
+
+		conn.Close()
+	}
+}
@@ -109,6 +109,9 @@ func (h *HTTPServerHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 				if c, ok := conn.(*MirrorHeaderConn); ok && c != nil {
 					conn = c.Conn
 				}
+				if c, ok := conn.(*ProxyProtocolConn); ok && c != nil {
+					conn = c.Conn
+				}
 				if tc, ok := conn.(*net.TCPConn); ok && tc != nil {
 					ri.ClientTCPConn = tc
 				}
@@ -121,8 +124,8 @@ func (h *HTTPServerHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/3.0", 3, 0
 	}
 
-	// fix real remote ip
-	if xfr := req.Header.Get("x-forwarded-for"); xfr != "" {
+	// fix real remote ip, the address from proxy protocol is trusted over x-forwarded-for
+	if xfr := req.Header.Get("x-forwarded-for"); xfr != "" && !h.Config.ProxyProtocol {
 		ri.RemoteIP = strings.Split(xfr, ",")[0]
 	}
 
@@ -30,12 +30,15 @@ type HTTPForwardHandler struct {
 	LocalTransport *http.Transport
 	Dialers        map[string]Dialer
 	Functions      template.FuncMap
+	RootCA         *RootCA
 
 	policy        *template.Template
 	tcpcongestion *template.Template
 	dialer        *template.Template
 	transports    map[string]*http.Transport
 	csvloader     *FileLoader[[]UserInfo]
+	denyloader    *FileLoader[DomainSet]
+	cache         *HTTPCache
 }
 
 func (h *HTTPForwardHandler) Load() error {
@@ -62,6 +65,18 @@ func (h *HTTPForwardHandler) Load() error {
 		}
 	}
 
+	if h.Config.Forward.Cache.Enabled {
+		h.cache = &HTTPCache{
+			MemorySize:   h.Config.Forward.Cache.MemorySize,
+			Dir:          h.Config.Forward.Cache.Dir,
+			MaxSize:      h.Config.Forward.Cache.MaxSize,
+			MaxEntrySize: h.Config.Forward.Cache.MaxEntrySize,
+		}
+		if err = h.cache.Load(); err != nil {
+			return err
+		}
+	}
+
 	if len(h.Dialers) != 0 {
 		h.transports = make(map[string]*http.Transport)
 		for name, dailer := range h.Dialers {
@@ -90,6 +105,23 @@ func (h *HTTPForwardHandler) Load() error {
 		log.Info().Strs("server_name", h.Config.ServerName).Str("auth_table", h.Config.Forward.AuthTable).Int("auth_table_size", len(*records)).Msg("load auth_table ok")
 	}
 
+	if h.Config.Forward.DenyDomainsTable != "" {
+		h.denyloader = &FileLoader[DomainSet]{
+			Filename:     h.Config.Forward.DenyDomainsTable,
+			Unmarshal:    DomainSetUnmarshal,
+			PollDuration: 15 * time.Second,
+			Logger:       log.DefaultLogger.Slog(),
+		}
+		if strings.HasSuffix(h.Config.Forward.DenyDomainsTable, ".csv") {
+			h.denyloader.Unmarshal = DomainSetCsvUnmarshal
+		}
+		records := h.denyloader.Load()
+		if records == nil {
+			log.Fatal().Strs("server_name", h.Config.ServerName).Str("deny_domains_table", h.Config.Forward.DenyDomainsTable).Msg("load deny_domains_table failed")
+		}
+		log.Info().Strs("server_name", h.Config.ServerName).Str("deny_domains_table", h.Config.Forward.DenyDomainsTable).Int("deny_domains_table_size", records.Len()).Msg("load deny_domains_table ok")
+	}
+
 	return nil
 }
 
@@ -130,6 +162,12 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 		return
 	}
 
+	if h.denyloader != nil && h.denyloader.Load().Contains(host) {
+		log.Info().Context(ri.LogContext).Str("forward_host", host).Str("deny_domains_table", h.Config.Forward.DenyDomainsTable).Msg("forward request denied by deny_domains_table")
+		RejectRequest(rw, req)
+		return
+	}
+
 	if ri.ProxyUser.Username != "" && h.Config.Forward.AuthTable != "" {
 		records := *h.csvloader.Load()
 		i, ok := slices.BinarySearchFunc(records, ri.ProxyUser, func(a, b UserInfo) int { return cmp.Compare(a.Username, b.Username) })
@@ -146,6 +184,9 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 	bb := bytebufferpool.Get()
 	defer bytebufferpool.Put(bb)
 
+	// inner requests of a mitm tunnel carry no proxy-authorization, their CONNECT was authenticated
+	mitm, _ := req.Context().Value(HTTPForwardMitmContextKey).(bool)
+
 	policyName := h.Config.Forward.Policy
 	speedLimit := h.Config.Forward.SpeedLimit
 	if h.policy != nil {
@@ -156,7 +197,8 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 			UserInfo        UserInfo
 			UserAgent       *useragent.UserAgent
 			ServerAddr      string
-		}{req, ri.ClientHelloInfo, ri.ProxyUser, &ri.UserAgent, ri.ServerAddr})
+			Mitm            bool
+		}{req, ri.ClientHelloInfo, ri.ProxyUser, &ri.UserAgent, ri.ServerAddr, mitm})
 		if err != nil {
 			log.Error().Err(err).Context(ri.LogContext).Str("forward_policy", h.Config.Forward.Policy).Interface("client_hello_info", ri.ClientHelloInfo).Interface("tls_connection_state", req.TLS).Msg("execute forward_policy error")
 			http.NotFound(rw, req)
@@ -181,6 +223,9 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 			}
 			return
 		case "require_auth", "require_proxy_auth", "require_www_auth":
+			if mitm {
+				break
+			}
 			var authCode int
 			var authHeader, authText string
 			switch policyName {
@@ -345,6 +390,11 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 			// FIXME: handle self-connect clients
 		}
 
+		if policyName == "mitm" && !tunnel {
+			h.serveMitm(rw, req, ri)
+			return
+		}
+
 		var dialer Dialer
 		if dialerName != "" {
 			if d, ok := h.Dialers[dialerName]; !ok {
@@ -463,6 +513,7 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 					Str("user_agent_name", ri.UserAgent.Name).
 					Str("user_agent_version", ri.UserAgent.Version).
 					Int64("speed_limit", speedLimit).
+					Str("forward_dialer_chain", DialerChain(h.Dialers, dialerName)).
 					Value(),
 				FieldName: "transmit_bytes",
 				Interval:  cmp.Or(h.Config.Forward.LogInterval, 1),
@@ -514,15 +565,36 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 			tr = h.LocalTransport
 		}
 
-		resp, err := tr.RoundTrip(req)
+		var resp *http.Response
+		var err error
+		// users with no_cache attribute always go to the origin
+		if h.cache != nil && req.Method == http.MethodGet && ri.ProxyUser.Attrs["no_cache"] != "1" {
+			// dialers may reach different origins for the same url, e.g. geo restricted contents
+			key := req.URL.String()
+			if dialerName != "" {
+				key += "\x00dialer=" + dialerName
+			}
+			var status string
+			resp, status, err = h.cache.RoundTrip(req, key, tr.RoundTrip)
+			if err == nil {
+				resp.Header.Set("x-cache-status", status)
+			}
+		} else {
+			resp, err = tr.RoundTrip(req)
+		}
 		if err != nil {
 			http.Error(rw, err.Error(), http.StatusBadGateway)
 			return
 		}
 
-		if h2 {
-			resp.Header.Del("connection")
-			resp.Header.Del("keep-alive")
+		// hop-by-hop headers belong to the upstream connection, the client connection stays reusable
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			for _, name := range strings.Split(resp.Header.Get("connection"), ",") {
+				resp.Header.Del(strings.TrimSpace(name))
+			}
+			for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Trailer"} {
+				resp.Header.Del(name)
+			}
 		}
 
 		for k, vv := range resp.Header {
@@ -530,7 +602,6 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 				rw.Header().Add(k, v)
 			}
 		}
-		rw.Header().Set("connection", "close")
 
 		rw.WriteHeader(resp.StatusCode)
 		defer resp.Body.Close()
@@ -559,6 +630,7 @@ func (h *HTTPForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 					Str("user_agent_name", ri.UserAgent.Name).
 					Str("user_agent_version", ri.UserAgent.Version).
 					Int64("speed_limit", speedLimit).
+					Str("forward_dialer_chain", DialerChain(h.Dialers, dialerName)).
 					Value(),
 				FieldName: "transmit_bytes",
 				Interval:  cmp.Or(h.Config.Forward.LogInterval, 1),
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/phuslu/log"
+)
+
+// HTTPForwardMitmContextKey marks the inner requests of a mitm tunnel, they inherit the user of the CONNECT request.
+var HTTPForwardMitmContextKey = struct {
+	name string
+}{"forward-mitm"}
+
+// serveMitm terminates the tls of a CONNECT request with a leaf certificate signed by RootCA,
+// the inner requests are served by the normal forward path.
+func (h *HTTPForwardHandler) serveMitm(rw http.ResponseWriter, req *http.Request, ri *RequestInfo) {
+	if h.RootCA == nil {
+		log.Error().Context(ri.LogContext).Str("req_host", req.Host).Msg("forward mitm requires root ca")
+		http.Error(rw, "mitm is not available", http.StatusBadGateway)
+		return
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(req.Host); err == nil {
+		host = h
+	}
+
+	var conn net.Conn
+	if req.ProtoAtLeast(2, 0) {
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			http.Error(rw, fmt.Sprintf("%#v is not http.Flusher", rw), http.StatusBadGateway)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		conn = &http2Stream{
+			r:          req.Body,
+			w:          FlushWriter{rw},
+			closed:     make(chan struct{}),
+			remoteAddr: &net.TCPAddr{IP: net.ParseIP(ri.RemoteIP)},
+			localAddr:  &net.TCPAddr{IP: net.ParseIP(ri.ServerAddr)},
+		}
+	} else {
+		hijacker, ok := rw.(http.Hijacker)
+		if !ok {
+			http.Error(rw, fmt.Sprintf("%#v is not http.Hijacker", rw), http.StatusBadGateway)
+			return
+		}
+		lconn, _, err := hijacker.Hijack()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		io.WriteString(lconn, "HTTP/1.1 200 OK\r\n\r\n")
+		conn = lconn
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return h.RootCA.Certificate(cmp.Or(hello.ServerName, host))
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+
+	log.Info().Context(ri.LogContext).Str("req_host", req.Host).Str("username", ri.ProxyUser.Username).Msg("forward mitm connect")
+
+	ln := &mitmListener{conn: tlsConn, done: make(chan struct{})}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			// each inner request gets its own copy, the forward path mutates it
+			rri := *ri
+			r.URL.Scheme = "https"
+			r.URL.Host = cmp.Or(r.Host, req.Host)
+			log.Debug().Context(ri.LogContext).Str("req_method", r.Method).Str("req_host", r.Host).Str("req_uri", r.RequestURI).Str("req_proto", r.Proto).Msg("forward mitm request")
+			ctx := context.WithValue(r.Context(), RequestInfoContextKey, &rri)
+			h.ServeHTTP(rw, r.WithContext(context.WithValue(ctx, HTTPForwardMitmContextKey, true)))
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				ln.Close()
+			}
+		},
+		ErrorLog: log.DefaultLogger.Std("", 0),
+	}
+
+	server.Serve(ln)
+}
+
+// mitmListener hands out a single conn, then blocks in Accept until the conn is finished.
+type mitmListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (ln *mitmListener) Accept() (net.Conn, error) {
+	if c := ln.conn; c != nil {
+		ln.conn = nil
+		return c, nil
+	}
+	<-ln.done
+	return nil, net.ErrClosed
+}
+
+func (ln *mitmListener) Close() error {
+	ln.once.Do(func() { close(ln.done) })
+	return nil
+}
+
+func (ln *mitmListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
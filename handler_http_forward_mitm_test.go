@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPForwardHandlerMitm(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "origin %s %s", req.Host, req.URL.Path)
+	}))
+	defer origin.Close()
+
+	ca := DefaultRootCA()
+	ca.DirName = t.TempDir()
+	ca.ForceRSA = false
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.RootCertificate())
+
+	cases := []struct {
+		Policy string
+		Status int
+	}{
+		// inner requests carry no proxy-authorization, auth results are skipped for them
+		{`{{if eq .Request.Method "CONNECT"}}mitm{{else}}require_proxy_auth{{end}}`, http.StatusOK},
+		{`{{if .Mitm}}verify_auth{{else if .Request.Header.Get "proxy-authorization"}}mitm{{else}}require_proxy_auth{{end}}`, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		var config HTTPConfig
+		config.Forward.Policy = c.Policy
+		h := &HTTPForwardHandler{
+			Config:         config,
+			LocalTransport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+			RootCA:         ca,
+		}
+		if err := h.Load(); err != nil {
+			t.Fatalf("HTTPForwardHandler.Load error: %+v", err)
+		}
+
+		var conns atomic.Int32
+		proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			conns.Add(1)
+			ri := &RequestInfo{RemoteIP: "127.0.0.1", ProxyUser: UserInfo{Username: "foo"}}
+			h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), RequestInfoContextKey, ri)))
+		}))
+
+		proxyURL, _ := url.Parse(proxy.URL)
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:              http.ProxyURL(proxyURL),
+			ProxyConnectHeader: http.Header{"Proxy-Authorization": {"Basic Zm9vOjEyMzQ1Ng=="}},
+			TLSClientConfig:    &tls.Config{RootCAs: roots},
+		}}
+
+		// the leaf certificate is minted for localhost by the root ca
+		target := strings.Replace(origin.URL, "127.0.0.1", "localhost", 1)
+		for range 2 {
+			resp, err := client.Get(target + "/hello")
+			if err != nil {
+				t.Fatalf("mitm request(%s) error: %+v", c.Policy, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != c.Status {
+				t.Errorf("mitm request(%s) must return %d, not %d %s", c.Policy, c.Status, resp.StatusCode, body)
+			}
+			if c.Status == http.StatusOK && !strings.HasSuffix(string(body), " /hello") {
+				t.Errorf("mitm request(%s) must reach the origin, not %#v", c.Policy, string(body))
+			}
+		}
+
+		// the inner connection is kept alive, one CONNECT serves both requests
+		if n := conns.Load(); n != 1 {
+			t.Errorf("mitm request(%s) must reuse the tunnel, not CONNECT %d times", c.Policy, n)
+		}
+
+		proxy.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPForwardHandlerCache(t *testing.T) {
+	var fetches atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("cache-control", "public, max-age=60")
+		fmt.Fprintf(rw, "pkg#%d", fetches.Add(1))
+	}))
+	defer origin.Close()
+
+	var config HTTPConfig
+	config.Forward.Policy = "proxy"
+	config.Forward.Dialer = `{{ .Request.Header.Get "x-dialer" }}`
+	config.Forward.Cache.Enabled = true
+	config.Forward.Cache.Dir = t.TempDir()
+
+	h := &HTTPForwardHandler{
+		Config:         config,
+		LocalTransport: &http.Transport{},
+		Dialers: map[string]Dialer{
+			"d1": streamTestDialer((&net.Dialer{}).DialContext),
+		},
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("HTTPForwardHandler.Load error: %+v", err)
+	}
+
+	var conns atomic.Int32
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ri := &RequestInfo{RemoteIP: "127.0.0.1", ProxyUser: UserInfo{Username: "foo"}}
+		if req.Header.Get("x-user") == "bar" {
+			ri.ProxyUser = UserInfo{Username: "bar", Attrs: map[string]any{"no_cache": "1"}}
+		}
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), RequestInfoContextKey, ri)))
+	}))
+	proxy.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	proxy.Start()
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	cases := []struct {
+		User   string
+		Dialer string
+		Status string
+		Body   string
+	}{
+		{"foo", "", "MISS", "pkg#1"},
+		{"foo", "", "HIT", "pkg#1"},
+		{"bar", "", "", "pkg#2"},
+		{"foo", "d1", "MISS", "pkg#3"},
+		{"foo", "d1", "HIT", "pkg#3"},
+		{"foo", "", "HIT", "pkg#1"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL+"/pool/a.deb", nil)
+		req.Header.Set("x-user", c.User)
+		req.Header.Set("x-dialer", c.Dialer)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("forward request error: %+v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if status := resp.Header.Get("x-cache-status"); status != c.Status || string(body) != c.Body {
+			t.Errorf("forward cache(user=%s dialer=%s) must return %s %#v, not %s %#v", c.User, c.Dialer, c.Status, c.Body, status, string(body))
+		}
+		if resp.Close {
+			t.Errorf("forward cache(user=%s dialer=%s) must keep the client connection alive", c.User, c.Dialer)
+		}
+	}
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("forward proxy clients must reuse 1 connection, not %d", n)
+	}
+}
@@ -8,13 +8,16 @@ import (
 	"net/netip"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/phuslu/log"
 )
 
 type HTTPWebHandler struct {
 	Config    HTTPConfig
+	Logger    log.Logger
 	Transport *http.Transport
+	Resolver  *Resolver
 	Functions template.FuncMap
 
 	wildcards []struct {
@@ -32,6 +35,18 @@ func (h *HTTPWebHandler) Load() error {
 
 	var routers []router
 	for _, web := range h.Config.Web {
+		var compressor *HTTPCompressor
+		if web.Compress.Enabled {
+			compressor = &HTTPCompressor{
+				Encodings:     web.Compress.Encodings,
+				Types:         web.Compress.Types,
+				MinLength:     web.Compress.MinLength,
+				Level:         web.Compress.Level,
+				Precompressed: web.Compress.Precompressed,
+			}
+		}
+
+		n := len(routers)
 		switch {
 		case web.Cgi.Enabled:
 			routers = append(routers, router{
@@ -50,6 +65,17 @@ func (h *HTTPWebHandler) Load() error {
 					AuthBasicUserFile: web.Dav.AuthBasicUserFile,
 				},
 			})
+		case web.Doh.Enabled:
+			routers = append(routers, router{
+				web.Location,
+				&HTTPWebDohHandler{
+					Logger:    h.Logger,
+					Resolver:  h.Resolver,
+					Functions: h.Functions,
+					Policy:    web.Doh.Policy,
+					Log:       web.Doh.Log,
+				},
+			})
 		case web.Index.Root != "" || web.Index.Body != "" || web.Index.File != "":
 			routers = append(routers, router{
 				web.Location,
@@ -60,9 +86,40 @@ func (h *HTTPWebHandler) Load() error {
 					Headers:   web.Index.Headers,
 					Body:      web.Index.Body,
 					File:      web.Index.File,
+					Compress:  compressor,
 				},
 			})
-		case web.Proxy.Pass != "":
+		case web.Proxy.Pass != "" || len(web.Proxy.Upstream.Servers) > 0:
+			var upstream *UpstreamPool
+			if len(web.Proxy.Upstream.Servers) > 0 {
+				var urls []string
+				var weights []int
+				for _, server := range web.Proxy.Upstream.Servers {
+					urls = append(urls, server.Url)
+					weights = append(weights, server.Weight)
+				}
+				pool, err := NewUpstreamPool(urls, weights)
+				if err != nil {
+					return err
+				}
+				pool.Balance = web.Proxy.Upstream.Balance
+				pool.HashCookie = web.Proxy.Upstream.HashCookie
+				pool.MaxFails = web.Proxy.Upstream.MaxFails
+				pool.FailTimeout = time.Duration(web.Proxy.Upstream.FailTimeout) * time.Second
+				pool.HealthCheckPath = web.Proxy.Upstream.HealthCheck.Path
+				pool.HealthCheckInterval = time.Duration(web.Proxy.Upstream.HealthCheck.Interval) * time.Second
+				pool.HealthCheckTimeout = time.Duration(web.Proxy.Upstream.HealthCheck.Timeout) * time.Second
+				upstream = pool
+			}
+			var cache *HTTPCache
+			if web.Proxy.Cache.Enabled {
+				cache = &HTTPCache{
+					MemorySize:   web.Proxy.Cache.MemorySize,
+					Dir:          web.Proxy.Cache.Dir,
+					MaxSize:      web.Proxy.Cache.MaxSize,
+					MaxEntrySize: web.Proxy.Cache.MaxEntrySize,
+				}
+			}
 			routers = append(routers, router{
 				web.Location,
 				&HTTPWebProxyHandler{
@@ -72,9 +129,20 @@ func (h *HTTPWebHandler) Load() error {
 					AuthBasicUserFile: web.Proxy.AuthBasicUserFile,
 					SetHeaders:        web.Proxy.SetHeaders,
 					DumpFailure:       web.Proxy.DumpFailure,
+					SendProxyProtocol: web.Proxy.SendProxyProtocol,
+					Upstream:          upstream,
+					Cache:             cache,
+					CacheKey:          web.Proxy.Cache.Key,
 				},
 			})
 		}
+
+		if compressor != nil && len(routers) > n {
+			routers[n].handler = &HTTPCompressHandler{
+				HTTPHandler: routers[n].handler,
+				Compressor:  compressor,
+			}
+		}
 	}
 
 	var root HTTPHandler
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"text/template"
+
+	"github.com/phuslu/fastdns"
+	"github.com/phuslu/log"
+)
+
+type HTTPWebDohHandler struct {
+	Logger    log.Logger
+	Resolver  *Resolver
+	Functions template.FuncMap
+	Policy    string
+	Log       bool
+
+	dns *DnsHandler
+}
+
+func (h *HTTPWebDohHandler) Load() error {
+	h.dns = &DnsHandler{
+		Config: DnsConfig{
+			Policy: h.Policy,
+			Log:    h.Log,
+		},
+		Logger:    h.Logger,
+		Resolver:  h.Resolver,
+		Functions: h.Functions,
+	}
+
+	return h.dns.Load()
+}
+
+// ServeHTTP serves dns wireformat queries over GET/POST, see RFC 8484.
+func (h *HTTPWebDohHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	ri := req.Context().Value(RequestInfoContextKey).(*RequestInfo)
+
+	var data []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodGet:
+		data, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("content-type") != "application/dns-message" {
+			http.Error(rw, "415 unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err = io.ReadAll(io.LimitReader(req.Body, 65535))
+	default:
+		rw.Header().Set("allow", "GET, POST")
+		http.Error(rw, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(data) == 0 {
+		log.Debug().Context(ri.LogContext).Err(err).Msg("web doh read message error")
+		http.Error(rw, "400 bad request", http.StatusBadRequest)
+		return
+	}
+
+	msg := fastdns.AcquireMessage()
+	defer fastdns.ReleaseMessage(msg)
+
+	if err = fastdns.ParseMessage(msg, data, true); err != nil {
+		log.Debug().Context(ri.LogContext).Err(err).Msg("web doh parse message error")
+		http.Error(rw, "400 bad request", http.StatusBadRequest)
+		return
+	}
+
+	h.dns.ServeDNS(req.Context(), &DnsHTTPWriter{
+		ResponseWriter: rw,
+		Request:        req,
+	}, &DnsRequest{
+		RemoteAddr: req.RemoteAddr,
+		RemoteIP:   ri.RemoteIP,
+		ServerAddr: ri.ServerAddr,
+		Message:    msg,
+		TraceID:    ri.TraceID,
+	})
+}
+
+var _ fastdns.ResponseWriter = (*DnsHTTPWriter)(nil)
+
+type DnsHTTPWriter struct {
+	ResponseWriter http.ResponseWriter
+	Request        *http.Request
+}
+
+func (rw *DnsHTTPWriter) RemoteAddr() netip.AddrPort {
+	ap, _ := netip.ParseAddrPort(rw.Request.RemoteAddr)
+	return ap
+}
+
+func (rw *DnsHTTPWriter) LocalAddr() netip.AddrPort {
+	if addr, ok := rw.Request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return AddrPortOf(addr)
+	}
+	return netip.AddrPort{}
+}
+
+func (rw *DnsHTTPWriter) Write(p []byte) (int, error) {
+	header := rw.ResponseWriter.Header()
+	header.Set("content-type", "application/dns-message")
+	header.Set("content-length", strconv.Itoa(len(p)))
+	if len(p) > 3 && fastdns.Rcode(p[3]&0x0f) == fastdns.RcodeNoError {
+		// the freshness lifetime is the min ttl of records, see RFC 8484 section 5.1
+		if ttl, ok := dnsMinTTL(p); ok {
+			header.Set("cache-control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+		}
+	}
+	rw.ResponseWriter.WriteHeader(http.StatusOK)
+	return rw.ResponseWriter.Write(p)
+}
+
+func dnsMinTTL(p []byte) (ttl uint32, ok bool) {
+	msg := fastdns.AcquireMessage()
+	defer fastdns.ReleaseMessage(msg)
+
+	if fastdns.ParseMessage(msg, p, true) != nil {
+		return 0, false
+	}
+
+	ttl = math.MaxUint32
+	for rr := range msg.Records {
+		ttl, ok = min(ttl, rr.TTL), true
+	}
+
+	return ttl, ok
+}
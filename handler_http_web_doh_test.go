@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/phuslu/fastdns"
+	"github.com/phuslu/lru"
+)
+
+func TestHTTPWebDohHandler(t *testing.T) {
+	h := &HTTPWebDohHandler{
+		Resolver: &Resolver{
+			Client:        newResolverTestClient(t, &resolverTestHandler{IP: netip.MustParseAddr("2.2.2.2")}),
+			CacheDuration: 10 * time.Minute,
+			LRUCache:      lru.NewTTLCache[string, []netip.Addr](1024),
+		},
+		Policy: `{{if eq .Request.Domain "blocked.example.org"}}nxdomain{{end}}`,
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("HTTPWebDohHandler.Load error: %+v", err)
+	}
+
+	cases := []struct {
+		Method  string
+		Domain  string
+		Status  int
+		Answers string
+		MaxAge  int
+	}{
+		{http.MethodGet, "www.example.org", http.StatusOK, "[2.2.2.2]", 60},
+		{http.MethodPost, "www.example.org", http.StatusOK, "[2.2.2.2]", 60},
+		{http.MethodGet, "blocked.example.org", http.StatusOK, "[]", -1},
+		{http.MethodPut, "www.example.org", http.StatusMethodNotAllowed, "", -1},
+		{http.MethodGet, "", http.StatusBadRequest, "", -1},
+	}
+
+	for _, c := range cases {
+		var data []byte
+		if c.Domain != "" {
+			msg := fastdns.AcquireMessage()
+			msg.SetRequestQuestion(c.Domain, fastdns.TypeA, fastdns.ClassINET)
+			data = append(data, msg.Raw...)
+			fastdns.ReleaseMessage(msg)
+		}
+
+		var req *http.Request
+		switch c.Method {
+		case http.MethodGet:
+			req = httptest.NewRequest(c.Method, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(data), nil)
+		default:
+			req = httptest.NewRequest(c.Method, "/dns-query", bytes.NewReader(data))
+			req.Header.Set("content-type", "application/dns-message")
+		}
+		ri := &RequestInfo{RemoteIP: "127.0.0.1", ServerAddr: "127.0.0.1:443"}
+		req = req.WithContext(context.WithValue(req.Context(), RequestInfoContextKey, ri))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != c.Status {
+			t.Errorf("doh %s %s must return %d, not %d", c.Method, c.Domain, c.Status, rec.Code)
+			continue
+		}
+		if c.Status != http.StatusOK {
+			continue
+		}
+		if _, answers, _ := dnsTestAnswer(t, rec.Body.Bytes()); answers != c.Answers {
+			t.Errorf("doh %s %s must answer %s, not %s", c.Method, c.Domain, c.Answers, answers)
+		}
+		// the max-age follows the record ttl, a cached answer may be a second older
+		maxAge := -1
+		if cc := rec.Header().Get("cache-control"); cc != "" {
+			fmt.Sscanf(cc, "max-age=%d", &maxAge)
+		}
+		if maxAge > c.MaxAge || maxAge+2 < c.MaxAge {
+			t.Errorf("doh %s %s must return max-age %d, not %d", c.Method, c.Domain, c.MaxAge, maxAge)
+		}
+	}
+}
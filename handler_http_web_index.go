@@ -27,6 +27,7 @@ type HTTPWebIndexHandler struct {
 	Body      string
 	File      string
 	Functions template.FuncMap
+	Compress  *HTTPCompressor
 
 	headers *template.Template
 	body    *template.Template
@@ -109,9 +110,11 @@ func (h *HTTPWebIndexHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 		b.Reset()
 
 		var w io.Writer = b
-		if ae := req.Header.Get("accept-encoding"); ae == "gzip" || strings.Contains(ae, "gzip,") {
+		// leave it to the location compressor if any, it honors the mime types and min_length
+		if h.Compress == nil && NegotiateContentEncoding(req.Header.Get("accept-encoding"), []string{"gzip"}) != "" {
 			w = gzip.NewWriter(b)
 			rw.Header().Set("content-encoding", "gzip")
+			rw.Header().Add("vary", "accept-encoding")
 		}
 
 		err := tmpl.Execute(w, struct {
@@ -164,10 +167,20 @@ func (h *HTTPWebIndexHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 
 	if !fi.IsDir() {
 
-		file, err := os.Open(fullname)
-		if err != nil {
-			http.Error(rw, "500 internal server error", http.StatusInternalServerError)
-			return
+		var encoding string
+		var file *os.File
+		if h.Compress != nil && req.Header.Get("range") == "" {
+			var fi2 fs.FileInfo
+			if file, fi2, encoding = h.Compress.OpenPrecompressed(fullname, req.Header.Get("accept-encoding")); file != nil {
+				fi = fi2
+			}
+		}
+		if file == nil {
+			file, err = os.Open(fullname)
+			if err != nil {
+				http.Error(rw, "500 internal server error", http.StatusInternalServerError)
+				return
+			}
 		}
 		defer file.Close()
 
@@ -177,7 +190,12 @@ func (h *HTTPWebIndexHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 		} else {
 			rw.Header().Set("content-type", "application/octet-stream")
 		}
-		rw.Header().Set("accept-ranges", "bytes")
+		if encoding != "" {
+			rw.Header().Set("content-encoding", encoding)
+			rw.Header().Add("vary", "accept-encoding")
+		} else {
+			rw.Header().Set("accept-ranges", "bytes")
+		}
 		if s := req.Header.Get("range"); s == "" {
 			rw.Header().Set("content-length", strconv.FormatInt(fi.Size(), 10))
 			rw.WriteHeader(http.StatusOK)
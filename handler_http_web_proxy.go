@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/netip"
@@ -26,11 +28,20 @@ type HTTPWebProxyHandler struct {
 	AuthBasicUserFile string
 	SetHeaders        string
 	DumpFailure       bool
+	SendProxyProtocol string
+	Upstream          *UpstreamPool
+	Cache             *HTTPCache
+	CacheKey          string
 
 	proxypass *template.Template
 	headers   *template.Template
+	cachekey  *template.Template
 }
 
+var HTTPWebProxyProtocolContextKey = struct {
+	name string
+}{"web-proxy-protocol"}
+
 func (h *HTTPWebProxyHandler) Load() error {
 	var err error
 
@@ -44,6 +55,56 @@ func (h *HTTPWebProxyHandler) Load() error {
 		return err
 	}
 
+	switch h.SendProxyProtocol {
+	case "":
+	case "v1", "v2":
+		// a proxy protocol header belongs to one client, so upstream connections are never reused
+		dial := h.Transport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		h.Transport = h.Transport.Clone()
+		h.Transport.DisableKeepAlives = true
+		h.Transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			addrs, ok := ctx.Value(HTTPWebProxyProtocolContextKey).([2]netip.AddrPort)
+			if !ok {
+				// requests of liner itself, e.g. upstream health checks, send the addresses of their own conn
+				addrs = [2]netip.AddrPort{AddrPortOf(conn.LocalAddr()), AddrPortOf(conn.RemoteAddr())}
+			}
+			header, _ := AppendProxyProtocolHeader(nil, h.SendProxyProtocol, addrs[0], addrs[1])
+			if _, err = conn.Write(header); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	default:
+		return fmt.Errorf("unsupported send_proxy_protocol %#v", h.SendProxyProtocol)
+	}
+
+	if h.Cache != nil {
+		if h.CacheKey != "" {
+			h.cachekey, err = template.New(h.CacheKey).Funcs(h.Functions).Parse(h.CacheKey)
+			if err != nil {
+				return err
+			}
+		}
+		if err = h.Cache.Load(); err != nil {
+			return err
+		}
+	}
+
+	if h.Upstream != nil {
+		h.Upstream.Transport = h.Transport
+		if err = h.Upstream.Load(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -78,22 +139,45 @@ func (h *HTTPWebProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	u, err := url.Parse(proxypass)
-	if err != nil {
-		http.Error(rw, fmt.Sprintf("bad proxypass %+v", proxypass), http.StatusServiceUnavailable)
-		return
-	}
+	// an empty pass goes to the upstream pool
+	var u *url.URL
+	if proxypass != "" || h.Upstream == nil {
+		var err error
+		u, err = url.Parse(proxypass)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("bad proxypass %+v", proxypass), http.StatusServiceUnavailable)
+			return
+		}
 
-	if u.Scheme == "file" {
-		http.Error(rw, "use index_root instead of file://", http.StatusServiceUnavailable)
-		return
+		if u.Scheme == "file" {
+			http.Error(rw, "use index_root instead of file://", http.StatusServiceUnavailable)
+			return
+		}
 	}
 
 	var tr http.RoundTripper = h.Transport
 
-	req.URL.Scheme = u.Scheme
-	req.URL.Host = u.Host
-	// req.Host = u.Host
+	if h.SendProxyProtocol != "" {
+		var source netip.AddrPort
+		if ap, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+			source = ap
+			// keep the client address recovered from x-forwarded-for or proxy protocol
+			if ip, err := netip.ParseAddr(ri.RemoteIP); err == nil {
+				source = netip.AddrPortFrom(ip, ap.Port())
+			}
+		}
+		var destination netip.AddrPort
+		if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			destination = AddrPortOf(addr)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), HTTPWebProxyProtocolContextKey, [2]netip.AddrPort{source, destination}))
+	}
+
+	if u != nil {
+		req.URL.Scheme = u.Scheme
+		req.URL.Host = u.Host
+		// req.Host = u.Host
+	}
 
 	if s := req.Header.Get("x-forwarded-for"); s != "" {
 		req.Header.Set("x-forwarded-for", s+", "+ri.RemoteIP)
@@ -126,7 +210,24 @@ func (h *HTTPWebProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 		}
 	}
 
-	resp, err := tr.RoundTrip(req)
+	roundtrip := tr.RoundTrip
+	if u == nil {
+		roundtrip = func(req *http.Request) (*http.Response, error) {
+			return h.roundTripUpstream(tr, req, ri)
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	if h.Cache != nil && req.Method == http.MethodGet && req.Header.Get("upgrade") == "" {
+		var status string
+		resp, status, err = h.Cache.RoundTrip(req, h.cacheKey(req, ri), roundtrip)
+		if err == nil {
+			resp.Header.Set("x-cache-status", status)
+		}
+	} else {
+		resp, err = roundtrip(req)
+	}
 	if err != nil {
 		if h.proxypass != nil {
 			log.Warn().Err(err).Context(ri.LogContext).Msg("proxypass error")
@@ -227,6 +328,64 @@ func (h *HTTPWebProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 	}
 }
 
+// roundTripUpstream sends req to a server picked from the upstream pool, idempotent requests without body
+// are retried on the other servers. The server is released once the response body is closed.
+func (h *HTTPWebProxyHandler) roundTripUpstream(tr http.RoundTripper, req *http.Request, ri *RequestInfo) (*http.Response, error) {
+	var retryable bool
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		retryable = req.ContentLength == 0 && len(req.TransferEncoding) == 0 && req.Header.Get("upgrade") == ""
+	}
+
+	var tried []*UpstreamServer
+	err := errors.New("no live upstreams")
+	for {
+		server := h.Upstream.Pick(req, ri.RemoteIP, tried)
+		if server == nil {
+			return nil, err
+		}
+		tried = append(tried, server)
+
+		done := h.Upstream.Acquire(server)
+		req.URL.Scheme = server.URL.Scheme
+		req.URL.Host = server.URL.Host
+
+		var resp *http.Response
+		resp, err = tr.RoundTrip(req)
+		if err == nil {
+			resp.Body = &UpstreamBody{ReadCloser: resp.Body, done: done}
+			return resp, nil
+		}
+		done(true)
+
+		log.Warn().Err(err).Context(ri.LogContext).Str("upstream_server", server.URL.String()).Bool("upstream_retry", retryable).Msg("proxy_pass upstream error")
+		if !retryable || req.Context().Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// cacheKey evaluates the cache key template, the default key is the host and request uri.
+func (h *HTTPWebProxyHandler) cacheKey(req *http.Request, ri *RequestInfo) string {
+	if h.cachekey == nil {
+		return req.Host + req.URL.RequestURI()
+	}
+
+	var sb strings.Builder
+	err := h.cachekey.Execute(&sb, struct {
+		Request    *http.Request
+		UserAgent  *useragent.UserAgent
+		GeoipInfo  GeoipInfo
+		ServerAddr string
+	}{req, &ri.UserAgent, ri.GeoipInfo, ri.ServerAddr})
+	if err != nil {
+		log.Warn().Err(err).Context(ri.LogContext).Str("cache_key", h.CacheKey).Msg("execute cache_key error")
+		return req.Host + req.URL.RequestURI()
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
 func (h *HTTPWebProxyHandler) setHeaders(req *http.Request, ri *RequestInfo) {
 	if h.SetHeaders == "" {
 		return
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"slices"
 	"strconv"
 	"strings"
@@ -38,9 +39,10 @@ type SocksHandler struct {
 	Dialers       map[string]Dialer
 	Functions     template.FuncMap
 
-	policy    *template.Template
-	dialer    *template.Template
-	csvloader *FileLoader[[]UserInfo]
+	policy     *template.Template
+	dialer     *template.Template
+	csvloader  *FileLoader[[]UserInfo]
+	denyloader *FileLoader[DomainSet]
 }
 
 func (h *SocksHandler) Load() error {
@@ -74,6 +76,23 @@ func (h *SocksHandler) Load() error {
 		log.Info().Str("auth_table", h.Config.Forward.AuthTable).Int("auth_table_size", len(*records)).Msg("load auth_table ok")
 	}
 
+	if h.Config.Forward.DenyDomainsTable != "" {
+		h.denyloader = &FileLoader[DomainSet]{
+			Filename:     h.Config.Forward.DenyDomainsTable,
+			Unmarshal:    DomainSetUnmarshal,
+			PollDuration: 15 * time.Second,
+			Logger:       log.DefaultLogger.Slog(),
+		}
+		if strings.HasSuffix(h.Config.Forward.DenyDomainsTable, ".csv") {
+			h.denyloader.Unmarshal = DomainSetCsvUnmarshal
+		}
+		records := h.denyloader.Load()
+		if records == nil {
+			log.Fatal().Str("deny_domains_table", h.Config.Forward.DenyDomainsTable).Msg("load deny_domains_table failed")
+		}
+		log.Info().Str("deny_domains_table", h.Config.Forward.DenyDomainsTable).Int("deny_domains_table_size", records.Len()).Msg("load deny_domains_table ok")
+	}
+
 	return nil
 }
 
@@ -86,35 +105,73 @@ func (h *SocksHandler) ServeConn(ctx context.Context, conn net.Conn) {
 	req.ServerAddr = conn.LocalAddr().String()
 	req.TraceID = log.NewXID()
 
+	// the whole handshake must be done in time, serve clears the deadline
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
 	var b [512]byte
-	n, err := io.ReadAtLeast(conn, b[:], 2)
-	if err != nil || n == 0 {
+	n, err := io.ReadFull(conn, b[:2])
+	if err != nil {
 		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks read handshake error")
 		return
 	}
 
 	req.Version = SocksVersion(b[0])
-	for i := 0; i < int(b[1]); i++ {
-		if b[i+2] == Socks5AuthMethodPassword {
-			req.SupportAuth = true
-			break
-		}
+	switch req.Version {
+	case VersionSocks4:
+		h.serveSocks4(ctx, conn, req, b[:], n)
+		return
+	case VersionSocks5:
+	default:
+		log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_version", int(req.Version)).Msg("socks unsupported version")
+		return
+	}
+
+	// VER(1) NMETHODS(1) METHODS(NMETHODS)
+	methods := b[2 : 2+int(b[1])]
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks read auth methods error")
+		return
 	}
+	req.SupportAuth = slices.Contains(methods, Socks5AuthMethodPassword)
 
+	method := Socks5AuthMethodNone
 	if h.Config.Forward.AuthTable != "" {
-		if !req.SupportAuth {
-			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks client not support auth")
+		method = Socks5AuthMethodPassword
+	}
+	if !slices.Contains(methods, method) {
+		log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Bytes("socks_auth_methods", methods).Msg("socks client has no acceptable auth method")
+		conn.Write([]byte{VersionSocks5, 0xff})
+		return
+	}
+
+	if _, err = conn.Write([]byte{VersionSocks5, method}); err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_policy", h.Config.Forward.Policy).Msg("socks write auth error")
+		return
+	}
+
+	if method == Socks5AuthMethodPassword {
+		// VER(1) ULEN(1) UNAME(ULEN) PLEN(1) PASSWD(PLEN), see RFC 1929
+		if _, err = io.ReadFull(conn, b[:2]); err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks read auth error")
 			return
 		}
-		conn.Write([]byte{VersionSocks5, byte(Socks5AuthMethodPassword)})
-		n, err = io.ReadAtLeast(conn, b[:], 4)
-		if err != nil || n == 0 {
+		if b[0] != 0x01 {
+			log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_auth_version", int(b[0])).Msg("socks unsupported auth version")
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		ulen := int(b[1])
+		if _, err = io.ReadFull(conn, b[:ulen+1]); err != nil {
 			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks read auth error")
 			return
 		}
-		// unpack username & password
-		req.User.Username = string(b[2 : 2+int(b[1])])
-		req.User.Password = string(b[3+int(b[1]) : 3+int(b[1])+int(b[2+int(b[1])])])
+		req.User.Username = string(b[:ulen])
+		plen := int(b[ulen])
+		if _, err = io.ReadFull(conn, b[:plen]); err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks read auth error")
+			return
+		}
+		req.User.Password = string(b[:plen])
 		// auth plugin
 		records := h.csvloader.Load()
 		i, ok := slices.BinarySearchFunc(*records, req.User, func(a, b UserInfo) int { return cmp.Compare(a.Username, b.Username) })
@@ -127,101 +184,161 @@ func (h *SocksHandler) ServeConn(ctx context.Context, conn net.Conn) {
 			req.User.AuthError = nil
 		}
 		if req.User.AuthError != nil {
-			log.Warn().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_version", int(req.Version)).Msg("auth error")
-			conn.Write([]byte{VersionSocks5, byte(Socks5StatusGeneralFailure)})
+			log.Warn().Err(req.User.AuthError).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_version", int(req.Version)).Msg("auth error")
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		if _, err = conn.Write([]byte{0x01, 0x00}); err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks write auth error")
 			return
 		}
 	}
 
-	// auth ok
-	n, err = conn.Write([]byte{VersionSocks5, Socks5AuthMethodNone})
-	if err != nil || n == 0 {
-		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_policy", h.Config.Forward.Policy).Msg("socks write auth error")
+	// VER(1) CMD(1) RSV(1) ATYP(1) DST.ADDR DST.PORT(2)
+	if _, err = io.ReadFull(conn, b[:5]); err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_policy", h.Config.Forward.Policy).Msg("socks read address error")
 		return
 	}
-
-	n, err = io.ReadAtLeast(conn, b[:], 8)
-	if (err != nil && !strings.HasSuffix(err.Error(), " EOF")) || n == 0 {
-		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_policy", h.Config.Forward.Policy).Msg("socks read address error")
+	if b[0] != VersionSocks5 {
+		log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_version", int(b[0])).Msg("socks unexpected request version")
+		WriteSocks5Status(conn, Socks5StatusGeneralFailure)
 		return
 	}
 
 	req.ConnectType = SocksCommand(b[1])
+	switch req.ConnectType {
+	case SocksCommandConnectTCP, SocksCommandBind, SocksCommandConnectUDP:
+	default:
+		log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_command", int(req.ConnectType)).Msg("socks unsupported command")
+		WriteSocks5Status(conn, Socks5StatusCommandNotSupported)
+		return
+	}
 
-	var addressType = Socks5AddressType(b[3])
-	switch addressType {
+	// b[3:5] holds ATYP and the first byte of DST.ADDR, which is the length of a domain name
+	switch Socks5AddressType(b[3]) {
 	case Socks5IPv4Address:
-		req.Host = net.IP(b[4:8]).String()
-	case Socks5DomainName:
-		req.Host = string(b[5 : 5+int(b[4])]) //b[4]表示域名的长度
+		n = 3 + 1 + 4 + 2
 	case Socks5IPv6Address:
-		req.Host = net.IP(b[4:20]).String()
+		n = 3 + 1 + 16 + 2
+	case Socks5DomainName:
+		n = 3 + 2 + int(b[4]) + 2
+		if b[4] == 0 {
+			WriteSocks5Status(conn, Socks5StatusAddressTypeNotSupported)
+			return
+		}
+	default:
+		log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_address_type", int(b[3])).Msg("socks unsupported address type")
+		WriteSocks5Status(conn, Socks5StatusAddressTypeNotSupported)
+		return
+	}
+	if _, err = io.ReadFull(conn, b[5:n]); err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_policy", h.Config.Forward.Policy).Msg("socks read address error")
+		return
 	}
-	req.Port = int(b[n-2])<<8 | int(b[n-1])
 
-	var speedLimit int64
-	if s, _ := req.User.Attrs["speed_limit"].(string); s != "" {
-		if n, _ := strconv.ParseInt(s, 10, 64); n > 0 {
-			speedLimit = n
-		}
+	req.Host, req.Port, _, err = ParseSocks5Address(b[3:n])
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks parse address error")
+		WriteSocks5Status(conn, Socks5StatusGeneralFailure)
+		return
 	}
 
-	bb := bytebufferpool.Get()
-	defer bytebufferpool.Put(bb)
+	h.serve(ctx, conn, req)
+}
 
-	var policyName = h.Config.Forward.Policy
-	if h.policy != nil {
-		bb.Reset()
-		err := h.policy.Execute(bb, struct {
-			Request    SocksRequest
-			ServerAddr string
-		}{req, req.ServerAddr})
-		if err != nil {
-			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_policy", h.Config.Forward.Policy).Msg("execute forward_policy error")
-			return
+// serveSocks4 reads a socks4 or socks4a request, the userid field is checked as username against auth_table.
+func (h *SocksHandler) serveSocks4(ctx context.Context, conn net.Conn, req SocksRequest, b []byte, n int) {
+	var userid string
+	var err error
+	for {
+		req.ConnectType, req.Host, req.Port, userid, err = ParseSocks4Request(b[:n])
+		if err != io.ErrUnexpectedEOF || n == len(b) {
+			break
 		}
-		policyName = strings.TrimSpace(bb.String())
-		log.Debug().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Interface("request", req).Str("forward_policy_name", policyName).Msg("execute forward_policy ok")
-
-		switch policyName {
-		case "reject", "deny":
-			WriteSocks5Status(conn, Socks5StatusConnectionNotAllowedByRuleset)
-			return
+		var m int
+		if m, err = conn.Read(b[n:]); err != nil {
+			break
 		}
+		n += m
+	}
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_version", int(req.Version)).Msg("socks read socks4 request error")
+		return
 	}
 
-	log.Info().Str("remote_ip", req.RemoteIP).Str("server_addr", req.ServerAddr).Int("socks_version", int(req.Version)).Str("username", req.User.Username).Str("socks_host", req.Host).Msg("forward socks request")
+	if req.ConnectType != SocksCommandConnectTCP && req.ConnectType != SocksCommandBind {
+		log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_version", int(req.Version)).Int("socks_command", int(req.ConnectType)).Msg("socks unsupported socks4 command")
+		WriteSocksStatus(conn, req.Version, Socks5StatusCommandNotSupported, netip.AddrPort{})
+		return
+	}
 
-	var dialerName = h.Config.Forward.Dialer
-	dail := h.LocalDialer.DialContext
-	if h.dialer != nil {
-		bb.Reset()
-		err := h.dialer.Execute(bb, struct {
-			Request    SocksRequest
-			ServerAddr string
-		}{req, req.ServerAddr})
-		if err != nil {
-			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Msg("execute forward_dialer error")
-			WriteSocks5Status(conn, Socks5StatusGeneralFailure)
+	if h.Config.Forward.AuthTable != "" {
+		// socks4 has no password, a "username:password" userid is checked in full,
+		// and a bare username only matches users without password
+		var password string
+		req.User.Username, password, _ = strings.Cut(userid, ":")
+		records := h.csvloader.Load()
+		i, ok := slices.BinarySearchFunc(*records, req.User, func(a, b UserInfo) int { return cmp.Compare(a.Username, b.Username) })
+		switch {
+		case !ok:
+			req.User.AuthError = fmt.Errorf("invalid username: %v", req.User.Username)
+		case password != (*records)[i].Password:
+			req.User.AuthError = fmt.Errorf("wrong password: %v", req.User.Username)
+		}
+		if req.User.AuthError != nil {
+			log.Warn().Err(req.User.AuthError).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_version", int(req.Version)).Msg("auth error")
+			WriteSocksStatus(conn, req.Version, Socks5StatusConnectionNotAllowedByRuleset, netip.AddrPort{})
 			return
 		}
+	} else {
+		req.User.Username = userid
+	}
 
-		if dialerName = strings.TrimSpace(bb.String()); dialerName != "" {
-			u, ok := h.Dialers[dialerName]
-			if !ok {
-				log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Str("dialer_name", dialerName).Msg("dialer not exists")
-				return
-			}
-			dail = u.DialContext
+	h.serve(ctx, conn, req)
+}
+
+// serve forwards a parsed socks request, the replies are written in the socks version of req.
+func (h *SocksHandler) serve(ctx context.Context, conn net.Conn, req SocksRequest) {
+	conn.SetDeadline(time.Time{})
+
+	if h.GeoResolver.FakeIP != nil {
+		req.Host = h.GeoResolver.FakeIP.ReverseHost(req.Host)
+	}
+
+	var speedLimit int64
+	if s, _ := req.User.Attrs["speed_limit"].(string); s != "" {
+		if n, _ := strconv.ParseInt(s, 10, 64); n > 0 {
+			speedLimit = n
 		}
 	}
 
-	network := "tcp"
 	switch req.ConnectType {
 	case SocksCommandConnectUDP:
-		network = "udp"
+		h.ServeUDP(ctx, conn, req)
+		return
+	case SocksCommandBind:
+		h.ServeBind(ctx, conn, req)
+		return
+	}
+
+	policyName, dialerName, dialer, err := h.forward(req)
+	if err != nil {
+		WriteSocksStatus(conn, req.Version, Socks5StatusGeneralFailure, netip.AddrPort{})
+		return
+	}
+
+	switch policyName {
+	case "reject", "deny":
+		WriteSocksStatus(conn, req.Version, Socks5StatusConnectionNotAllowedByRuleset, netip.AddrPort{})
+		return
 	}
 
+	log.Info().Str("remote_ip", req.RemoteIP).Str("server_addr", req.ServerAddr).Int("socks_version", int(req.Version)).Str("username", req.User.Username).Str("socks_host", req.Host).Msg("forward socks request")
+
+	dail := dialer.DialContext
+
+	network := "tcp"
+
 	log.Info().Str("server_addr", req.ServerAddr).Int("socks_version", int(req.Version)).Str("username", req.User.Username).Str("remote_ip", req.RemoteIP).Str("socks_network", network).Str("socks_host", req.Host).Int("socks_port", req.Port).Str("forward_policy_name", policyName).Str("forward_dialer_name", dialerName).Msg("forward socks request")
 
 	ctx = context.WithValue(context.Background(), DialerHTTPHeaderContextKey, http.Header{
@@ -231,7 +348,7 @@ func (h *SocksHandler) ServeConn(ctx context.Context, conn net.Conn) {
 	rconn, err := dail(ctx, network, net.JoinHostPort(req.Host, strconv.Itoa(req.Port)))
 	if err != nil {
 		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Str("socks_host", req.Host).Int("socks_port", req.Port).Int("socks_version", int(req.Version)).Str("forward_policy_name", policyName).Str("forward_dialer_name", dialerName).Msg("connect remote host failed")
-		WriteSocks5Status(conn, Socks5StatusNetworkUnreachable)
+		WriteSocksStatus(conn, req.Version, Socks5StatusNetworkUnreachable, netip.AddrPort{})
 		if rconn != nil {
 			rconn.Close()
 		}
@@ -239,9 +356,13 @@ func (h *SocksHandler) ServeConn(ctx context.Context, conn net.Conn) {
 	}
 	defer rconn.Close()
 
-	WriteSocks5Status(conn, Socks5StatusRequestGranted)
+	WriteSocksStatus(conn, req.Version, Socks5StatusRequestGranted, netip.AddrPort{})
 
-	if tc, _ := conn.(*net.TCPConn); conn != nil && speedLimit > 0 {
+	tc, _ := conn.(*net.TCPConn)
+	if c, ok := conn.(*ProxyProtocolConn); ok {
+		tc, _ = c.Conn.(*net.TCPConn)
+	}
+	if tc != nil && speedLimit > 0 {
 		SetTcpMaxPacingRate(tc, int(speedLimit))
 	}
 
@@ -253,7 +374,59 @@ func (h *SocksHandler) ServeConn(ctx context.Context, conn net.Conn) {
 		if h.GeoResolver.CityReader != nil {
 			country, city, _ = h.GeoResolver.LookupCity(context.Background(), net.ParseIP(req.RemoteIP))
 		}
-		h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_city", city).Str("forward_dialer_name", h.Config.Forward.Dialer).Str("socks_host", req.Host).Int("socks_port", req.Port).Int("socks_version", int(req.Version)).Str("forward_dialer_name", dialerName).Msg("forward socks request end")
+		h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_city", city).Str("forward_dialer_name", h.Config.Forward.Dialer).Str("socks_host", req.Host).Int("socks_port", req.Port).Int("socks_version", int(req.Version)).Str("forward_dialer_name", dialerName).Str("forward_dialer_chain", DialerChain(h.Dialers, dialerName)).Msg("forward socks request end")
+	}
+
+	return
+}
+
+// forward executes the forward policy and dialer templates against req,
+// hosts in deny_domains_table are denied before any template runs.
+func (h *SocksHandler) forward(req SocksRequest) (policyName, dialerName string, dialer Dialer, err error) {
+	if h.denyloader != nil && h.denyloader.Load().Contains(req.Host) {
+		log.Info().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("socks_host", req.Host).Str("deny_domains_table", h.Config.Forward.DenyDomainsTable).Msg("forward socks request denied by deny_domains_table")
+		return "deny", "", nil, nil
+	}
+
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+
+	policyName = h.Config.Forward.Policy
+	if h.policy != nil {
+		bb.Reset()
+		err = h.policy.Execute(bb, struct {
+			Request    SocksRequest
+			ServerAddr string
+		}{req, req.ServerAddr})
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_policy", h.Config.Forward.Policy).Msg("execute forward_policy error")
+			return
+		}
+		policyName = strings.TrimSpace(bb.String())
+		log.Debug().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Interface("request", req).Str("forward_policy_name", policyName).Msg("execute forward_policy ok")
+	}
+
+	dialerName, dialer = h.Config.Forward.Dialer, h.LocalDialer
+	if h.dialer != nil {
+		bb.Reset()
+		err = h.dialer.Execute(bb, struct {
+			Request    SocksRequest
+			ServerAddr string
+		}{req, req.ServerAddr})
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Msg("execute forward_dialer error")
+			return
+		}
+
+		if dialerName = strings.TrimSpace(bb.String()); dialerName != "" {
+			d, ok := h.Dialers[dialerName]
+			if !ok {
+				err = fmt.Errorf("dialer %#v not exists", dialerName)
+				log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("forward_dialer_name", h.Config.Forward.Dialer).Str("dialer_name", dialerName).Msg("dialer not exists")
+				return
+			}
+			dialer = d
+		}
 	}
 
 	return
@@ -262,3 +435,29 @@ func (h *SocksHandler) ServeConn(ctx context.Context, conn net.Conn) {
 func WriteSocks5Status(conn net.Conn, status Socks5Status) (int, error) {
 	return conn.Write([]byte{VersionSocks5, byte(status), 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 }
+
+// WriteSocksStatus writes a socks4 or socks5 reply with the bound address, socks4 clients
+// only tell apart granted and rejected requests.
+func WriteSocksStatus(conn net.Conn, version SocksVersion, status Socks5Status, bind netip.AddrPort) (int, error) {
+	switch version {
+	case 0:
+		// redir and tproxy connections carry no socks replies
+		return 0, nil
+	case VersionSocks4:
+		code := byte(Socks4StatusRequestGranted)
+		if status != Socks5StatusRequestGranted {
+			code = Socks4StatusConnectionForbidden
+		}
+		ip := bind.Addr().Unmap()
+		if !ip.Is4() {
+			ip = netip.IPv4Unspecified()
+		}
+		b := ip.As4()
+		return conn.Write([]byte{0x00, code, byte(bind.Port() >> 8), byte(bind.Port()), b[0], b[1], b[2], b[3]})
+	}
+
+	if !bind.IsValid() {
+		return WriteSocks5Status(conn, status)
+	}
+	return conn.Write(AppendSocks5Address([]byte{VersionSocks5, byte(status), 0x00}, bind.Addr().Unmap().String(), int(bind.Port())))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+// ServeBind serves a BIND request of protocols like active ftp, see RFC 1928 section 4.
+// The first reply carries the listening address, the second one carries the address of
+// the accepted peer, which must be the destination of the request unless it is unspecified.
+func (h *SocksHandler) ServeBind(ctx context.Context, conn net.Conn, req SocksRequest) {
+	policyName, _, _, err := h.forward(req)
+	if err != nil {
+		WriteSocksStatus(conn, req.Version, Socks5StatusGeneralFailure, netip.AddrPort{})
+		return
+	}
+
+	switch policyName {
+	case "reject", "deny":
+		WriteSocksStatus(conn, req.Version, Socks5StatusConnectionNotAllowedByRuleset, netip.AddrPort{})
+		return
+	}
+
+	var peers []netip.Addr
+	if ip, err := netip.ParseAddr(req.Host); err == nil {
+		if !ip.IsUnspecified() {
+			peers = append(peers, ip.Unmap())
+		}
+	} else {
+		ips, err := h.LocalDialer.Resolver.LookupNetIP(ctx, "ip", req.Host)
+		if err != nil || len(ips) == 0 {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("socks_host", req.Host).Int("socks_version", int(req.Version)).Msg("socks bind resolve host error")
+			WriteSocksStatus(conn, req.Version, Socks5StatusHostUnreachable, netip.AddrPort{})
+			return
+		}
+		for _, ip := range ips {
+			peers = append(peers, ip.Unmap())
+		}
+	}
+
+	var laddr net.TCPAddr
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = addr.IP
+	}
+
+	ln, err := net.ListenTCP("tcp", &laddr)
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_version", int(req.Version)).Msg("socks bind listen error")
+		WriteSocksStatus(conn, req.Version, Socks5StatusGeneralFailure, netip.AddrPort{})
+		return
+	}
+	defer ln.Close()
+
+	bind := ln.Addr().(*net.TCPAddr).AddrPort()
+	if _, err := WriteSocksStatus(conn, req.Version, Socks5StatusRequestGranted, bind); err != nil {
+		return
+	}
+
+	log.Info().Str("server_addr", req.ServerAddr).Int("socks_version", int(req.Version)).Str("username", req.User.Username).Str("remote_ip", req.RemoteIP).Str("socks_host", req.Host).Int("socks_port", req.Port).Str("forward_policy_name", policyName).Stringer("socks_bind_addr", bind).Msg("forward socks bind request")
+
+	ln.SetDeadline(time.Now().Add(2 * time.Minute))
+
+	var rconn *net.TCPConn
+	var raddr netip.AddrPort
+	for rconn == nil {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("socks_host", req.Host).Stringer("socks_bind_addr", bind).Msg("socks bind accept error")
+			WriteSocksStatus(conn, req.Version, Socks5StatusTTLExpired, netip.AddrPort{})
+			return
+		}
+		raddr = c.RemoteAddr().(*net.TCPAddr).AddrPort()
+		if len(peers) > 0 && !slices.Contains(peers, raddr.Addr().Unmap()) {
+			log.Warn().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("socks_host", req.Host).Stringer("socks_bind_peer", raddr).Msg("socks bind reject unexpected peer")
+			c.Close()
+			continue
+		}
+		rconn = c
+	}
+	defer rconn.Close()
+	ln.Close()
+
+	if _, err := WriteSocksStatus(conn, req.Version, Socks5StatusRequestGranted, raddr); err != nil {
+		return
+	}
+
+	go io.Copy(rconn, conn)
+	_, err = io.Copy(conn, rconn)
+
+	if h.Config.Forward.Log {
+		h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("username", req.User.Username).Str("socks_host", req.Host).Int("socks_port", req.Port).Int("socks_version", int(req.Version)).Stringer("socks_bind_peer", raddr).Msg("forward socks bind request end")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/valyala/bytebufferpool"
+)
+
+// ServeRedirConn serves a connection redirected by iptables REDIRECT or TPROXY. The original
+// destination is recovered from SO_ORIGINAL_DST or the local address, and is replaced by the
+// TLS SNI or HTTP Host sniffed from the first packet before the policy and dialer templates run.
+func (h *SocksHandler) ServeRedirConn(ctx context.Context, conn net.Conn, tproxy bool) {
+	defer conn.Close()
+
+	var req SocksRequest
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.RemoteIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	req.ServerAddr = conn.LocalAddr().String()
+	req.TraceID = log.NewXID()
+	req.ConnectType = SocksCommandConnectTCP
+
+	dst := AddrPortOf(conn.LocalAddr())
+	if !tproxy {
+		tc, ok := conn.(*net.TCPConn)
+		if !ok {
+			log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msgf("redir unsupported connection type %T", conn)
+			return
+		}
+		var err error
+		if dst, err = GetOriginalDst(tc); err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("redir get original destination error")
+			return
+		}
+		// a connection to the listener itself was not redirected, serving it would loop forever
+		if dst == AddrPortOf(conn.LocalAddr()) {
+			log.Warn().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("redir connection is not redirected")
+			return
+		}
+	}
+
+	req.Host, req.Port = dst.Addr().Unmap().String(), int(dst.Port())
+
+	// sniff the first packet, clients of server-speaks-first protocols are not kept waiting
+	mc := &MirrorHeaderConn{Conn: conn}
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	var b [4096]byte
+	_, err := mc.Read(b[:])
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		log.Debug().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("redir read first packet error")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var data []byte
+	if mc.Header != nil {
+		data = append(data, mc.Header.B...)
+		bytebufferpool.Put(mc.Header)
+	}
+
+	if host := SniffServerName(conn, data); host != "" {
+		log.Debug().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_addr", dst.String()).Str("redir_sniff_host", host).Msg("redir sniff host ok")
+		req.Host = host
+	}
+
+	log.Info().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("redir_addr", dst.String()).Str("socks_host", req.Host).Int("socks_port", req.Port).Bool("tproxy", tproxy).Msg("forward redir request")
+
+	h.serve(ctx, &ConnWithData{Conn: conn, Data: data}, req)
+}
+
+// SniffServerName returns the TLS SNI or the HTTP Host of the first packet of conn.
+func SniffServerName(conn net.Conn, data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+
+	var host string
+	switch {
+	case data[0] == 0x16: // tls handshake record
+		if hello := SniffClientHello(conn, data); hello != nil {
+			host = hello.ServerName
+		}
+	case 'A' <= data[0] && data[0] <= 'Z':
+		if req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data))); err == nil {
+			host = req.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+		}
+	}
+
+	return strings.TrimSuffix(host, ".")
+}
+
+// SniffClientHello parses the TLS ClientHello in data without answering it, returns nil if data is not a ClientHello.
+func SniffClientHello(conn net.Conn, data []byte) (hello *tls.ClientHelloInfo) {
+	errSniffed := errors.New("sniffed")
+	tls.Server(&sniffConn{Conn: conn, Reader: bytes.NewReader(data)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errSniffed
+		},
+	}).Handshake()
+	return
+}
+
+// sniffConn replays the sniffed data to a tls server and drops its replies.
+type sniffConn struct {
+	net.Conn
+	io.Reader
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+func (c *sniffConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
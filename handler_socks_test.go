@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestSocksHandlerHandshake(t *testing.T) {
+	filename := t.TempDir() + "/authuser.csv"
+	if err := os.WriteFile(filename, []byte("username,password\nfoo,123456\n"), 0644); err != nil {
+		t.Fatalf("write auth_table error: %+v", err)
+	}
+
+	var config SocksConfig
+	config.Forward.AuthTable = filename
+	h := &SocksHandler{Config: config}
+	if err := h.Load(); err != nil {
+		t.Fatalf("SocksHandler.Load() error: %+v", err)
+	}
+
+	auth := func(username, password string) []byte {
+		return append(append(append([]byte{0x01, byte(len(username))}, username...), byte(len(password))), password...)
+	}
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	cases := []struct {
+		Name    string
+		Request [][]byte
+		Reply   []byte
+	}{
+		{
+			"no acceptable auth method",
+			[][]byte{{0x05, 0x01, 0x00}},
+			[]byte{0x05, 0xff},
+		},
+		{
+			"wrong password",
+			[][]byte{cat([]byte{0x05, 0x02, 0x00, 0x02}, auth("foo", "654321"))},
+			[]byte{0x05, 0x02, 0x01, 0x01},
+		},
+		{
+			"invalid username",
+			[][]byte{cat([]byte{0x05, 0x01, 0x02}, auth("bar", "123456"))},
+			[]byte{0x05, 0x02, 0x01, 0x01},
+		},
+		{
+			"unsupported auth version",
+			[][]byte{{0x05, 0x01, 0x02, 0x02, 0x03}},
+			[]byte{0x05, 0x02, 0x01, 0x01},
+		},
+		{
+			// the whole handshake arrives at once, it must be read by exact lengths
+			"unsupported command",
+			[][]byte{cat([]byte{0x05, 0x01, 0x02}, auth("foo", "123456"), []byte{0x05, 0x09, 0x00, 0x01, 1, 2, 3, 4, 0x00, 0x50})},
+			[]byte{0x05, 0x02, 0x01, 0x00, 0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			"empty domain name",
+			[][]byte{cat([]byte{0x05, 0x01, 0x02}, auth("foo", "123456")), {0x05, 0x01, 0x00, 0x03, 0x00}},
+			[]byte{0x05, 0x02, 0x01, 0x00, 0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			"unsupported address type",
+			[][]byte{cat([]byte{0x05, 0x01, 0x02}, auth("foo", "123456"), []byte{0x05, 0x01, 0x00, 0x02, 0x00})},
+			[]byte{0x05, 0x02, 0x01, 0x00, 0x05, 0x08, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			"unexpected request version",
+			[][]byte{cat([]byte{0x05, 0x01, 0x02}, auth("foo", "123456"), []byte{0x04, 0x01, 0x00, 0x01, 0x00})},
+			[]byte{0x05, 0x02, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			// socks4a request split over writes, the userid is checked against auth_table
+			"socks4 invalid username",
+			[][]byte{{0x04, 0x01, 0x00, 0x50, 0, 0}, cat([]byte{0, 1}, []byte("bar\x00example.org\x00"))},
+			[]byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			"socks4 unsupported command",
+			[][]byte{cat([]byte{0x04, 0x03, 0x00, 0x50, 1, 2, 3, 4}, []byte("foo\x00"))},
+			[]byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0},
+		},
+	}
+
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go h.ServeConn(context.Background(), server)
+		go func() {
+			for _, b := range c.Request {
+				if _, err := client.Write(b); err != nil {
+					return
+				}
+			}
+		}()
+		reply, _ := io.ReadAll(client)
+		client.Close()
+		if !bytes.Equal(reply, c.Reply) {
+			t.Errorf("%s: socks handshake must reply %v, not %v", c.Name, c.Reply, reply)
+		}
+	}
+}
+
+func TestSocksHandlerSocks4Auth(t *testing.T) {
+	filename := t.TempDir() + "/authuser.csv"
+	if err := os.WriteFile(filename, []byte("username,password\nfoo,123456\nbaz,\n"), 0644); err != nil {
+		t.Fatalf("write auth_table error: %+v", err)
+	}
+
+	// the remote host accepts and closes, so granted requests end with the remote
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %+v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	var config SocksConfig
+	config.Forward.AuthTable = filename
+	h := newSocksTestHandler(t, config, nil)
+
+	cases := []struct {
+		UserID string
+		Code   byte
+	}{
+		{"foo:123456", 0x5a},
+		{"foo:654321", 0x5b},
+		// a bare username must not skip the password of the user
+		{"foo", 0x5b},
+		{"baz", 0x5a},
+		{"baz:", 0x5a},
+		{"bar", 0x5b},
+	}
+
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go h.ServeConn(context.Background(), server)
+		go client.Write(append([]byte{0x04, 0x01, byte(port >> 8), byte(port), 127, 0, 0, 1}, c.UserID+"\x00"...))
+		reply, _ := io.ReadAll(client)
+		client.Close()
+		if len(reply) < 2 || reply[1] != c.Code {
+			t.Errorf("socks4 userid %#v must reply %#x, not %v", c.UserID, c.Code, reply)
+		}
+	}
+}
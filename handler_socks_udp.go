@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+const (
+	socksUDPMaxSessions  = 256              // max destinations of an association, also caps denied destinations
+	socksUDPDenyDuration = 30 * time.Second // how long datagrams to a denied or unreachable destination are dropped
+	socksUDPMaxHeader    = 3 + 1 + 1 + 255 + 2
+)
+
+// ServeUDP serves a socks5 UDP ASSOCIATE request with a dedicated udp relay, see RFC 1928 section 7.
+// Each destination runs through the forward policy and dialer templates once, and the association
+// is torn down when the control connection closes.
+func (h *SocksHandler) ServeUDP(ctx context.Context, conn net.Conn, req SocksRequest) {
+	var laddr net.UDPAddr
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		laddr.IP = addr.IP
+	}
+
+	pc, err := net.ListenUDP("udp", &laddr)
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks listen udp relay error")
+		WriteSocks5Status(conn, Socks5StatusGeneralFailure)
+		return
+	}
+	defer pc.Close()
+
+	bind := pc.LocalAddr().(*net.UDPAddr).AddrPort()
+	_, err = conn.Write(AppendSocks5Address([]byte{VersionSocks5, byte(Socks5StatusRequestGranted), 0x00}, bind.Addr().Unmap().String(), int(bind.Port())))
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks write udp associate reply error")
+		return
+	}
+
+	log.Info().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Int("socks_version", int(req.Version)).Str("username", req.User.Username).Stringer("socks_udp_relay", bind).Msg("forward socks udp associate")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// tear down the association once the control connection closes
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+		pc.Close()
+	}()
+
+	clientIP, _ := netip.ParseAddr(req.RemoteIP)
+
+	var mu sync.Mutex
+	sessions := make(map[string]net.Conn)
+	defer func() {
+		mu.Lock()
+		for _, rconn := range sessions {
+			rconn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	// denied or failed destinations are dropped silently until the deadline in unix nanoseconds
+	denied := make(map[string]int64)
+
+	b := make([]byte, 65536)
+	for {
+		n, caddr, err := pc.ReadFromUDPAddrPort(b)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks read udp relay error")
+			}
+			return
+		}
+
+		// only accept datagrams from the client of control connection, and fragmentation is not supported
+		if caddr.Addr().Unmap() != clientIP.Unmap() || n < 4 || b[2] != 0x00 {
+			continue
+		}
+
+		host, port, data, err := ParseSocks5Address(b[3:n])
+		if err != nil {
+			log.Debug().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("socks parse udp header error")
+			continue
+		}
+
+		if h.GeoResolver.FakeIP != nil {
+			host = h.GeoResolver.FakeIP.ReverseHost(host)
+		}
+
+		key := net.JoinHostPort(host, strconv.Itoa(port))
+
+		mu.Lock()
+		rconn, count := sessions[key], len(sessions)
+		mu.Unlock()
+
+		if rconn == nil {
+			now := time.Now().UnixNano()
+			if deadline, ok := denied[key]; ok {
+				if now < deadline {
+					continue
+				}
+				delete(denied, key)
+			}
+
+			if count >= socksUDPMaxSessions {
+				log.Debug().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("socks_host", host).Int("socks_port", port).Int("socks_udp_sessions", count).Msg("socks udp sessions exceeded")
+				continue
+			}
+
+			sreq := req
+			sreq.Host, sreq.Port = host, port
+
+			var local bool
+			rconn, local, err = h.dialUDP(ctx, sreq)
+			if err != nil {
+				if len(denied) >= socksUDPMaxSessions {
+					for k, deadline := range denied {
+						if now >= deadline {
+							delete(denied, k)
+						}
+					}
+				}
+				if len(denied) < socksUDPMaxSessions {
+					denied[key] = now + int64(socksUDPDenyDuration)
+				}
+				continue
+			}
+
+			mu.Lock()
+			sessions[key] = rconn
+			mu.Unlock()
+
+			go func(rconn net.Conn, local bool, caddr netip.AddrPort, req SocksRequest) {
+				defer func() {
+					mu.Lock()
+					delete(sessions, key)
+					mu.Unlock()
+					rconn.Close()
+				}()
+
+				// the source of replies is known to packet conns only, the remote address of
+				// other dialers may be the relay of an upstream proxy
+				pconn, _ := rconn.(net.PacketConn)
+				var header []byte
+				if pconn == nil {
+					host := req.Host
+					if addr, ok := rconn.RemoteAddr().(*net.UDPAddr); ok && local {
+						host = addr.AddrPort().Addr().Unmap().String()
+					}
+					header = AppendSocks5Address([]byte{0x00, 0x00, 0x00}, host, req.Port)
+				}
+
+				var transmitBytes int64
+				// the payload is read after room for the longest header, which is then prepended in place
+				buf := make([]byte, 65536)
+				payload := buf[socksUDPMaxHeader:]
+				for {
+					rconn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+					var n int
+					var err error
+					if pconn != nil {
+						var addr net.Addr
+						if n, addr, err = pconn.ReadFrom(payload); err == nil {
+							header = appendSocks5UDPHeader(header[:0], addr)
+						}
+					} else {
+						n, err = rconn.Read(payload)
+					}
+					if err != nil {
+						break
+					}
+					start := socksUDPMaxHeader - len(header)
+					copy(buf[start:], header)
+					if _, err = pc.WriteToUDPAddrPort(buf[start:socksUDPMaxHeader+n], caddr); err != nil {
+						break
+					}
+					transmitBytes += int64(n)
+				}
+
+				if h.Config.Forward.Log {
+					h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("username", req.User.Username).Str("socks_host", req.Host).Int("socks_port", req.Port).Int("socks_version", int(req.Version)).Int64("transmit_bytes", transmitBytes).Msg("forward socks udp request end")
+				}
+			}(rconn, local, caddr, sreq)
+		}
+
+		rconn.Write(data)
+	}
+}
+
+// dialUDP dials the destination of req, local reports whether the local dialer was used.
+func (h *SocksHandler) dialUDP(ctx context.Context, req SocksRequest) (rconn net.Conn, local bool, err error) {
+	policyName, dialerName, dialer, err := h.forward(req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch policyName {
+	case "reject", "deny":
+		log.Info().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("socks_host", req.Host).Int("socks_port", req.Port).Str("forward_policy_name", policyName).Msg("forward socks udp request rejected")
+		return nil, false, errors.New("socks udp request rejected by " + policyName)
+	}
+
+	ctx = context.WithValue(ctx, DialerHTTPHeaderContextKey, http.Header{
+		"X-Forwarded-For":  []string{req.RemoteIP},
+		"X-Forwarded-User": []string{req.User.Username},
+	})
+	rconn, err = dialer.DialContext(ctx, "udp", net.JoinHostPort(req.Host, strconv.Itoa(req.Port)))
+	if err != nil {
+		log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("socks_host", req.Host).Int("socks_port", req.Port).Str("forward_policy_name", policyName).Str("forward_dialer_name", dialerName).Msg("connect remote udp host failed")
+		return nil, false, err
+	}
+
+	log.Info().Str("server_addr", req.ServerAddr).Int("socks_version", int(req.Version)).Str("username", req.User.Username).Str("remote_ip", req.RemoteIP).Str("socks_network", "udp").Str("socks_host", req.Host).Int("socks_port", req.Port).Str("forward_policy_name", policyName).Str("forward_dialer_name", dialerName).Str("forward_dialer_chain", DialerChain(h.Dialers, dialerName)).Msg("forward socks request")
+
+	return rconn, dialer == h.LocalDialer, nil
+}
+
+// appendSocks5UDPHeader appends a socks5 udp request header of addr to dst, see RFC 1928 section 7.
+func appendSocks5UDPHeader(dst []byte, addr net.Addr) []byte {
+	dst = append(dst, 0x00, 0x00, 0x00)
+	if addr, ok := addr.(*net.UDPAddr); ok {
+		ap := addr.AddrPort()
+		return AppendSocks5Address(dst, ap.Addr().Unmap().String(), int(ap.Port()))
+	}
+	host, port, _ := net.SplitHostPort(addr.String())
+	n, _ := strconv.Atoi(port)
+	return AppendSocks5Address(dst, host, n)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/phuslu/fastdns"
+	"github.com/phuslu/lru"
+)
+
+// newSocksTestServer serves h on a loopback tcp port.
+func newSocksTestServer(t *testing.T, h *SocksHandler) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %+v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go h.ServeConn(context.Background(), conn)
+		}
+	}()
+
+	return ln
+}
+
+func newSocksTestHandler(t *testing.T, config SocksConfig, functions template.FuncMap) *SocksHandler {
+	h := &SocksHandler{
+		Config:      config,
+		GeoResolver: &GeoResolver{},
+		LocalDialer: &LocalDialer{
+			Resolver:     &Resolver{Client: &fastdns.Client{}},
+			ResolveCache: lru.NewTTLCache[string, []netip.Addr](1024),
+		},
+		Functions: functions,
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("SocksHandler.Load error: %+v", err)
+	}
+	return h
+}
+
+// newSocksTestEchoServer echoes udp datagrams prefixed with "echo:".
+func newSocksTestEchoServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenUDP error: %+v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		b := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(b)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDPAddrPort(append([]byte("echo:"), b[:n]...), addr)
+		}
+	}()
+
+	return conn
+}
+
+func TestSocksHandlerServeUDP(t *testing.T) {
+	var policies atomic.Int32
+	var config SocksConfig
+	config.Forward.Policy = `{{count}}{{if eq .Request.Port 9}}deny{{end}}`
+	h := newSocksTestHandler(t, config, template.FuncMap{"count": func() string { policies.Add(1); return "" }})
+	ln := newSocksTestServer(t, h)
+	echo := newSocksTestEchoServer(t)
+	echoAddr := echo.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	ctrl, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial error: %+v", err)
+	}
+	defer ctrl.Close()
+
+	ctrl.SetDeadline(time.Now().Add(2 * time.Second))
+	ctrl.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(ctrl, reply); err != nil || reply[3] != 0x00 {
+		t.Fatalf("socks udp associate must succeed, not %v err=%+v", reply, err)
+	}
+	_, relayPort, _, _ := ParseSocks5Address(reply[2+3:])
+	relay := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: relayPort}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenUDP error: %+v", err)
+	}
+	defer client.Close()
+
+	header := AppendSocks5Address([]byte{0x00, 0x00, 0x00}, echoAddr.Addr().String(), int(echoAddr.Port()))
+	read := func() ([]byte, error) {
+		b := make([]byte, 65536)
+		client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, _, err := client.ReadFromUDP(b)
+		return b[:n], err
+	}
+
+	// fragmented datagrams are dropped
+	client.WriteToUDP(append([]byte{0x00, 0x00, 0x01}, append(header[3:], "fragment"...)...), relay)
+	// datagrams of other hosts are dropped
+	if other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}); err == nil {
+		other.WriteToUDP(append(header, "other"...), relay)
+		other.Close()
+	}
+
+	client.WriteToUDP(append(header, "hello"...), relay)
+	data, err := read()
+	if err != nil {
+		t.Fatalf("socks udp relay must reply, err=%+v", err)
+	}
+	// the reply header carries the source of the reply, not the relay or the dialer address
+	if want := append(header, "echo:hello"...); !bytes.Equal(data, want) {
+		t.Errorf("socks udp relay must reply %q, not %q", want, data)
+	}
+
+	// denied destinations run the policy once, later datagrams are dropped silently
+	denied := AppendSocks5Address([]byte{0x00, 0x00, 0x00}, "127.0.0.1", 9)
+	for range 3 {
+		client.WriteToUDP(append(denied, "discard"...), relay)
+	}
+	client.WriteToUDP(append(header, "world"...), relay)
+	if data, err := read(); err != nil || !bytes.Equal(data, append(header, "echo:world"...)) {
+		t.Errorf("socks udp relay must only reply echo:world, not %q err=%+v", data, err)
+	}
+	if n := policies.Load(); n != 2 {
+		t.Errorf("socks udp relay must run forward_policy 2 times, not %d", n)
+	}
+
+	// the relay is torn down with the control connection
+	ctrl.Close()
+	time.Sleep(100 * time.Millisecond)
+	client.WriteToUDP(append(header, "closed"...), relay)
+	if data, err := read(); err == nil {
+		t.Errorf("socks udp relay must be closed with the control connection, not reply %q", data)
+	}
+}
@@ -3,14 +3,20 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"slices"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/phuslu/log"
+	"github.com/valyala/bytebufferpool"
 )
 
 type StreamRequest struct {
@@ -26,11 +32,69 @@ type StreamHandler struct {
 	GeoResolver   *GeoResolver
 	LocalDialer   *LocalDialer
 	Dialers       map[string]Dialer
+	Functions     template.FuncMap
 
-	tlsConfig *tls.Config
+	tlsConfig  *tls.Config
+	proxypass  *template.Template
+	dialer     *template.Template
+	sniproxies []StreamSniproxy
+}
+
+// StreamSniproxy routes connections whose ClientHello matches the server names and alpn protocols.
+type StreamSniproxy struct {
+	ServerNames *DomainSet
+	Alpn        []string
+	ProxyPass   string
+	Dialer      string
 }
 
 func (h *StreamHandler) Load() error {
+	switch h.Config.SendProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("unsupported send_proxy_protocol %#v", h.Config.SendProxyProtocol)
+	}
+
+	for _, listen := range h.Config.Listen {
+		if u, err := url.Parse(listen); err == nil && strings.HasPrefix(u.Scheme, "udp") && u.Host != "" {
+			if h.Config.ProxyProtocol || h.Config.SendProxyProtocol != "" {
+				return fmt.Errorf("stream %s: proxy_protocol and send_proxy_protocol are not supported by udp listeners", listen)
+			}
+		}
+	}
+
+	var err error
+
+	h.Config.ProxyPass = strings.TrimSpace(h.Config.ProxyPass)
+	if s := h.Config.ProxyPass; strings.Contains(s, "{{") {
+		if h.proxypass, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	}
+
+	h.Config.Dialer = strings.TrimSpace(h.Config.Dialer)
+	if s := h.Config.Dialer; strings.Contains(s, "{{") {
+		if h.dialer, err = template.New(s).Funcs(h.Functions).Parse(s); err != nil {
+			return err
+		}
+	}
+
+	for _, sniproxy := range h.Config.Sniproxy {
+		if sniproxy.ProxyPass == "" {
+			return fmt.Errorf("stream sniproxy %v: empty proxy_pass", sniproxy.ServerName)
+		}
+		names := new(DomainSet)
+		if err = DomainSetUnmarshal([]byte(strings.Join(sniproxy.ServerName, "\n")), names); err != nil {
+			return err
+		}
+		h.sniproxies = append(h.sniproxies, StreamSniproxy{
+			ServerNames: names,
+			Alpn:        sniproxy.Alpn,
+			ProxyPass:   sniproxy.ProxyPass,
+			Dialer:      sniproxy.Dialer,
+		})
+	}
+
 	keyfile, certfile := h.Config.Keyfile, h.Config.Certfile
 	if certfile == "" {
 		certfile = keyfile
@@ -66,26 +130,47 @@ func (h *StreamHandler) ServeConn(conn net.Conn) {
 	req.ServerAddr = conn.LocalAddr().String()
 	req.TraceID = log.NewXID()
 
-	if tc, _ := conn.(*net.TCPConn); conn != nil && h.Config.SpeedLimit > 0 {
+	tc, _ := conn.(*net.TCPConn)
+	if c, ok := conn.(*ProxyProtocolConn); ok {
+		tc, _ = c.Conn.(*net.TCPConn)
+	}
+	if tc != nil && h.Config.SpeedLimit > 0 {
 		err := SetTcpMaxPacingRate(tc, int(h.Config.SpeedLimit))
 		log.DefaultLogger.Err(err).Str("stream_proxy_pass", h.Config.ProxyPass).Str("remote_ip", req.RemoteIP).Str("stream_dialer_name", h.Config.Dialer).Int64("stream_speedlimit", h.Config.SpeedLimit).Msg("set speedlimit")
 	}
 
+	proxyPass, dialerName := h.Config.ProxyPass, h.Config.Dialer
+	if h.proxypass != nil || h.dialer != nil || len(h.sniproxies) > 0 {
+		hello, data, err := h.sniff(conn)
+		if err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Msg("stream sniff client hello error")
+			return
+		}
+		conn = &ConnWithData{Conn: conn, Data: data}
+		if proxyPass, dialerName, err = h.route(req, hello); err != nil {
+			log.Error().Err(err).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("stream_proxy_pass", h.Config.ProxyPass).Str("stream_dialer_name", h.Config.Dialer).Msg("stream route error")
+			return
+		}
+		if hello != nil {
+			log.Debug().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("server_name", hello.ServerName).Strs("alpn", hello.SupportedProtos).Str("stream_proxy_pass", proxyPass).Str("stream_dialer_name", dialerName).Msg("stream route client hello")
+		}
+	}
+
 	if h.tlsConfig != nil {
 		tconn := tls.Server(conn, h.tlsConfig)
 		err := tconn.HandshakeContext(ctx)
 		if err != nil {
-			log.Error().Err(err).Str("stream_proxy_pass", h.Config.ProxyPass).Str("remote_ip", req.RemoteIP).Str("stream_dialer_name", h.Config.Dialer).Msg("connect remote host failed")
+			log.Error().Err(err).Str("stream_proxy_pass", proxyPass).Str("remote_ip", req.RemoteIP).Str("stream_dialer_name", dialerName).Msg("connect remote host failed")
 			return
 		}
 		conn = tconn
 	}
 
 	dail := h.LocalDialer.DialContext
-	if h.Config.Dialer != "" {
-		dialer, ok := h.Dialers[h.Config.Dialer]
+	if dialerName != "" {
+		dialer, ok := h.Dialers[dialerName]
 		if !ok {
-			log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("stream_dialer_name", h.Config.Dialer).Msg("dialer not exists")
+			log.Error().Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("stream_dialer_name", dialerName).Msg("dialer not exists")
 			return
 		}
 		dail = dialer.DialContext
@@ -100,10 +185,10 @@ func (h *StreamHandler) ServeConn(conn net.Conn) {
 			ctx, cancel = context.WithTimeout(ctx, time.Duration(h.Config.DialTimeout)*time.Second)
 			defer cancel()
 		}
-		if !strings.Contains(h.Config.ProxyPass, "://") {
-			return dail(ctx, "tcp", h.Config.ProxyPass)
+		if !strings.Contains(proxyPass, "://") {
+			return dail(ctx, "tcp", h.reverse(proxyPass))
 		}
-		u, err := url.Parse(h.Config.ProxyPass)
+		u, err := url.Parse(proxyPass)
 		if err != nil {
 			return nil, err
 		}
@@ -111,16 +196,24 @@ func (h *StreamHandler) ServeConn(conn net.Conn) {
 		case "unix", "unixgram":
 			return dail(ctx, u.Scheme, u.Path)
 		default:
-			return dail(ctx, u.Scheme, u.Host)
+			return dail(ctx, u.Scheme, h.reverse(u.Host))
 		}
 	}(ctx)
 	if err != nil {
-		log.Error().Err(err).Str("stream_proxy_pass", h.Config.ProxyPass).Str("remote_ip", req.RemoteIP).Str("stream_dialer_name", h.Config.Dialer).Msg("connect remote host failed")
+		log.Error().Err(err).Str("stream_proxy_pass", proxyPass).Str("remote_ip", req.RemoteIP).Str("stream_dialer_name", dialerName).Msg("connect remote host failed")
 		return
 	}
 	defer rconn.Close()
 
-	log.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("proxy_pass", h.Config.ProxyPass).Str("stream_dialer_name", h.Config.Dialer).Msg("forward stream")
+	if h.Config.SendProxyProtocol != "" {
+		header, _ := AppendProxyProtocolHeader(nil, h.Config.SendProxyProtocol, AddrPortOf(conn.RemoteAddr()), AddrPortOf(conn.LocalAddr()))
+		if _, err = rconn.Write(header); err != nil {
+			log.Error().Err(err).Str("stream_proxy_pass", proxyPass).Str("remote_ip", req.RemoteIP).Str("stream_dialer_name", dialerName).Msg("write proxy protocol header failed")
+			return
+		}
+	}
+
+	log.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("proxy_pass", proxyPass).Str("stream_dialer_name", dialerName).Msg("forward stream")
 
 	go io.Copy(rconn, conn)
 	_, err = io.Copy(conn, rconn)
@@ -130,7 +223,99 @@ func (h *StreamHandler) ServeConn(conn net.Conn) {
 		if h.GeoResolver.CityReader != nil {
 			country, city, _ = h.GeoResolver.LookupCity(ctx, net.ParseIP(req.RemoteIP))
 		}
-		h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_city", city).Str("stream_dialer_name", h.Config.Dialer).Msg("forward port request end")
+		h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_city", city).Str("stream_dialer_name", dialerName).Str("stream_dialer_chain", DialerChain(h.Dialers, dialerName)).Msg("forward port request end")
+	}
+
+	return
+}
+
+// reverse translates fake ip addresses back to domains, so that remote dialers resolve the real ones.
+func (h *StreamHandler) reverse(addr string) string {
+	if h.GeoResolver.FakeIP == nil {
+		return addr
+	}
+	return h.GeoResolver.FakeIP.ReverseHost(addr)
+}
+
+// sniff reads the first tls record of conn, hello is nil if the client does not start with a ClientHello.
+func (h *StreamHandler) sniff(conn net.Conn) (hello *tls.ClientHelloInfo, data []byte, err error) {
+	defer conn.SetReadDeadline(time.Time{})
+
+	// server-speaks-first protocols never send a record header, they go to the default proxy_pass
+	// once the first byte is overdue. tls clients send the ClientHello right after connecting.
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	data = make([]byte, 5, 1024)
+	n, err := conn.Read(data[:1])
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, data[:0], nil
+		}
+		return nil, nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data[0] != 0x16 {
+		return nil, data[:n], nil
+	}
+	if n, err = io.ReadFull(conn, data[1:]); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, data[:1+n], nil
+		}
+		return nil, nil, err
+	}
+
+	length := int(data[3])<<8 | int(data[4])
+	data = append(data, make([]byte, length)...)
+	if _, err = io.ReadFull(conn, data[5:]); err != nil {
+		return nil, nil, err
+	}
+
+	return SniffClientHello(conn, data), data, nil
+}
+
+// route picks the proxy_pass and dialer of the first matching sniproxy, or evaluates the stream ones.
+func (h *StreamHandler) route(req StreamRequest, hello *tls.ClientHelloInfo) (proxyPass, dialerName string, err error) {
+	if hello != nil {
+		for _, sniproxy := range h.sniproxies {
+			if sniproxy.ServerNames.Len() > 0 && !sniproxy.ServerNames.Contains(hello.ServerName) {
+				continue
+			}
+			if len(sniproxy.Alpn) > 0 && !slices.ContainsFunc(hello.SupportedProtos, func(proto string) bool { return slices.Contains(sniproxy.Alpn, proto) }) {
+				continue
+			}
+			return sniproxy.ProxyPass, sniproxy.Dialer, nil
+		}
+	} else {
+		hello = &tls.ClientHelloInfo{}
+	}
+
+	proxyPass, dialerName = h.Config.ProxyPass, h.Config.Dialer
+
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+
+	data := struct {
+		Request         StreamRequest
+		ClientHelloInfo *tls.ClientHelloInfo
+		ServerAddr      string
+	}{req, hello, req.ServerAddr}
+
+	if h.proxypass != nil {
+		bb.Reset()
+		if err = h.proxypass.Execute(bb, data); err != nil {
+			return
+		}
+		if proxyPass = strings.TrimSpace(bb.String()); proxyPass == "" {
+			return "", "", errors.New("empty proxy_pass")
+		}
+	}
+
+	if h.dialer != nil {
+		bb.Reset()
+		if err = h.dialer.Execute(bb, data); err != nil {
+			return
+		}
+		dialerName = strings.TrimSpace(bb.String())
 	}
 
 	return
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamHandlerSniff(t *testing.T) {
+	h := &StreamHandler{}
+
+	// server-speaks-first clients stay silent, they must not wait for the full record deadline
+	c1, c2 := net.Pipe()
+	start := time.Now()
+	hello, data, err := h.sniff(c1)
+	if err != nil || hello != nil || len(data) != 0 {
+		t.Errorf("StreamHandler.sniff(silent) must return nil hello and no data, not %v %q err=%+v", hello, data, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("StreamHandler.sniff(silent) must give up on the first byte quickly, not after %s", d)
+	}
+	c1.Close()
+	c2.Close()
+
+	c1, c2 = net.Pipe()
+	go c2.Write([]byte("SSH-2.0-OpenSSH\r\n"))
+	hello, data, err = h.sniff(c1)
+	if err != nil || hello != nil || string(data) != "S" {
+		t.Errorf("StreamHandler.sniff(ssh) must return nil hello and \"S\", not %v %q err=%+v", hello, data, err)
+	}
+	c1.Close()
+	c2.Close()
+
+	c1, c2 = net.Pipe()
+	go tls.Client(c2, &tls.Config{ServerName: "example.org", NextProtos: []string{"h2"}}).Handshake()
+	hello, data, err = h.sniff(c1)
+	switch {
+	case err != nil:
+		t.Errorf("StreamHandler.sniff(tls) error: %+v", err)
+	case hello == nil || hello.ServerName != "example.org":
+		t.Errorf("StreamHandler.sniff(tls) must return server name \"example.org\", not %+v", hello)
+	case data[0] != 0x16 || len(data) != 5+(int(data[3])<<8|int(data[4])):
+		t.Errorf("StreamHandler.sniff(tls) must return the whole record, not %d bytes", len(data))
+	}
+	c1.Close()
+	c2.Close()
+}
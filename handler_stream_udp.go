@@ -0,0 +1,191 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+// ServePacketConn forwards udp datagrams of each client through its own upstream session,
+// sessions are closed after idle_timeout seconds without traffic in either direction.
+func (h *StreamHandler) ServePacketConn(ctx context.Context, pc net.PacketConn) {
+	defer pc.Close()
+
+	dial := h.LocalDialer.DialContext
+	if h.Config.Dialer != "" {
+		dialer, ok := h.Dialers[h.Config.Dialer]
+		if !ok {
+			log.Error().Str("server_addr", pc.LocalAddr().String()).Str("stream_dialer_name", h.Config.Dialer).Msg("dialer not exists")
+			return
+		}
+		dial = dialer.DialContext
+	}
+
+	network, addr := "udp", h.Config.ProxyPass
+	if u, err := url.Parse(h.Config.ProxyPass); err == nil && u.Scheme != "" && u.Host != "" {
+		network, addr = u.Scheme, u.Host
+	}
+	if !strings.HasPrefix(network, "udp") {
+		log.Error().Str("server_addr", pc.LocalAddr().String()).Str("stream_proxy_pass", h.Config.ProxyPass).Msg("stream udp listener requires an udp proxy_pass")
+		return
+	}
+
+	idleTimeout := time.Duration(cmp.Or(h.Config.IdleTimeout, 60)) * time.Second
+
+	var mu sync.Mutex
+	sessions := make(map[string]*streamUDPSession)
+	defer func() {
+		mu.Lock()
+		for _, session := range sessions {
+			session.Close()
+		}
+		mu.Unlock()
+	}()
+
+	var tempDelay time.Duration
+	b := make([]byte, 65536)
+	for {
+		n, caddr, err := pc.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// back off like net/http does for accept errors, a single bad datagram must not end the listener
+			tempDelay = min(max(tempDelay*2, 5*time.Millisecond), time.Second)
+			log.Error().Err(err).Str("server_addr", pc.LocalAddr().String()).Dur("retry_in", tempDelay).Msg("stream read udp error")
+			time.Sleep(tempDelay)
+			continue
+		}
+		tempDelay = 0
+
+		key := caddr.String()
+
+		mu.Lock()
+		session := sessions[key]
+		if session == nil {
+			session = &streamUDPSession{
+				queue: make(chan []byte, 64),
+				done:  make(chan struct{}),
+			}
+			sessions[key] = session
+		}
+		mu.Unlock()
+
+		session.Touch()
+
+		if session.started.CompareAndSwap(false, true) {
+			var req StreamRequest
+			req.RemoteAddr = key
+			req.RemoteIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+			req.ServerAddr = pc.LocalAddr().String()
+			req.TraceID = log.NewXID()
+
+			// dial in the session goroutine, a slow upstream must not stall the datagrams of other clients
+			go func(session *streamUDPSession, caddr net.Addr, req StreamRequest) {
+				defer func() {
+					mu.Lock()
+					if sessions[key] == session {
+						delete(sessions, key)
+					}
+					mu.Unlock()
+					session.Close()
+				}()
+
+				rconn, err := func(ctx context.Context) (net.Conn, error) {
+					ctx = context.WithValue(ctx, DialerHTTPHeaderContextKey, http.Header{
+						"X-Forwarded-For": []string{req.RemoteIP},
+					})
+					if h.Config.DialTimeout > 0 {
+						var cancel context.CancelFunc
+						ctx, cancel = context.WithTimeout(ctx, time.Duration(h.Config.DialTimeout)*time.Second)
+						defer cancel()
+					}
+					return dial(ctx, network, h.reverse(addr))
+				}(ctx)
+				if err != nil {
+					log.Error().Err(err).Str("stream_proxy_pass", h.Config.ProxyPass).Str("remote_ip", req.RemoteIP).Str("stream_dialer_name", h.Config.Dialer).Msg("connect remote udp host failed")
+					return
+				}
+				log.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("proxy_pass", h.Config.ProxyPass).Str("stream_dialer_name", h.Config.Dialer).Msg("forward udp stream")
+
+				// datagrams queued while dialing and later ones are written in order, the conn is closed with the session
+				go func() {
+					for {
+						select {
+						case p := <-session.queue:
+							if _, err := rconn.Write(p); err != nil {
+								log.Debug().Err(err).Str("stream_proxy_pass", h.Config.ProxyPass).Str("remote_addr", key).Msg("stream write udp error")
+							}
+						case <-session.done:
+							rconn.Close()
+							return
+						}
+					}
+				}()
+
+				var transmitBytes int64
+				buf := make([]byte, 65536)
+				for {
+					rconn.SetReadDeadline(time.Unix(0, session.active.Load()).Add(idleTimeout))
+					n, err := rconn.Read(buf)
+					if err != nil {
+						// the client may still be sending, the session is idle only without traffic in both directions
+						if IsTimeout(err) && time.Since(time.Unix(0, session.active.Load())) < idleTimeout {
+							continue
+						}
+						break
+					}
+					session.Touch()
+					if _, err = pc.WriteTo(buf[:n], caddr); err != nil {
+						break
+					}
+					transmitBytes += int64(n)
+				}
+
+				if h.Config.Log {
+					var country, city string
+					if h.GeoResolver.CityReader != nil {
+						country, city, _ = h.GeoResolver.LookupCity(ctx, net.ParseIP(req.RemoteIP))
+					}
+					h.ForwardLogger.Info().Stringer("trace_id", req.TraceID).Str("server_addr", req.ServerAddr).Str("remote_ip", req.RemoteIP).Str("remote_country", country).Str("remote_city", city).Str("stream_dialer_name", h.Config.Dialer).Str("stream_dialer_chain", DialerChain(h.Dialers, h.Config.Dialer)).Int64("transmit_bytes", transmitBytes).Msg("forward udp port request end")
+				}
+			}(session, caddr, req)
+		}
+
+		select {
+		case session.queue <- slices.Clone(b[:n]):
+		default:
+			log.Debug().Str("stream_proxy_pass", h.Config.ProxyPass).Str("remote_addr", key).Msg("stream udp queue full, drop datagram")
+		}
+	}
+}
+
+// streamUDPSession is the upstream conn of a udp client, datagrams are queued until the dial finishes.
+type streamUDPSession struct {
+	queue   chan []byte
+	active  atomic.Int64
+	started atomic.Bool
+	once    sync.Once
+	done    chan struct{}
+}
+
+// Touch records traffic of either direction for the idle timeout.
+func (s *streamUDPSession) Touch() {
+	s.active.Store(time.Now().UnixNano())
+}
+
+func (s *streamUDPSession) Close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
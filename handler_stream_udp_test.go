@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type streamTestDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (d streamTestDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+func newStreamTestPacketConn(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket error: %+v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func TestStreamHandlerUDPSlowDial(t *testing.T) {
+	upstream := newStreamTestPacketConn(t)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := upstream.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			upstream.WriteTo(b[:n], addr)
+		}
+	}()
+
+	slow := make(chan struct{})
+	var dials atomic.Int32
+	h := &StreamHandler{
+		Config:      StreamConfig{ProxyPass: upstream.LocalAddr().String(), Dialer: "test"},
+		GeoResolver: &GeoResolver{},
+		Dialers: map[string]Dialer{
+			"test": streamTestDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if dials.Add(1) == 1 {
+					<-slow
+				}
+				return net.Dial(network, addr)
+			}),
+		},
+	}
+
+	pc := newStreamTestPacketConn(t)
+	go h.ServePacketConn(context.Background(), pc)
+
+	c1, c2 := newStreamTestPacketConn(t), newStreamTestPacketConn(t)
+	c1.WriteTo([]byte("first"), pc.LocalAddr())
+	time.Sleep(100 * time.Millisecond)
+	c2.WriteTo([]byte("second"), pc.LocalAddr())
+
+	b := make([]byte, 1500)
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := c2.ReadFrom(b); err != nil || string(b[:n]) != "second" {
+		t.Fatalf("a slow dial must not stall other clients, got %q err=%+v", b[:n], err)
+	}
+
+	close(slow)
+	c1.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := c1.ReadFrom(b); err != nil || string(b[:n]) != "first" {
+		t.Errorf("the datagram queued while dialing must be forwarded, got %q err=%+v", b[:n], err)
+	}
+}
+
+func TestStreamHandlerUDPIdleTimeout(t *testing.T) {
+	// the upstream never replies, the session is kept alive by the client only
+	upstream := newStreamTestPacketConn(t)
+
+	var dials atomic.Int32
+	h := &StreamHandler{
+		Config:      StreamConfig{ProxyPass: upstream.LocalAddr().String(), Dialer: "test", IdleTimeout: 1},
+		GeoResolver: &GeoResolver{},
+		Dialers: map[string]Dialer{
+			"test": streamTestDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dials.Add(1)
+				return net.Dial(network, addr)
+			}),
+		},
+	}
+
+	pc := newStreamTestPacketConn(t)
+	go h.ServePacketConn(context.Background(), pc)
+
+	c := newStreamTestPacketConn(t)
+	for range 6 {
+		c.WriteTo([]byte("ping"), pc.LocalAddr())
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	if n := dials.Load(); n != 1 {
+		t.Errorf("client traffic must keep the udp session alive, dials must be 1, not %d", n)
+	}
+}
+
+func TestStreamHandlerUDPLoad(t *testing.T) {
+	cases := []struct {
+		Config StreamConfig
+		Error  bool
+	}{
+		{StreamConfig{Listen: []string{"udp://:5353"}, ProxyPass: "udp://1.1.1.1:53"}, false},
+		{StreamConfig{Listen: []string{"udp://:5353"}, ProxyPass: "udp://1.1.1.1:53", ProxyProtocol: true}, true},
+		{StreamConfig{Listen: []string{":5353", "udp://:5353"}, ProxyPass: "1.1.1.1:53", SendProxyProtocol: "v2"}, true},
+		{StreamConfig{Listen: []string{":5353"}, ProxyPass: "1.1.1.1:53", ProxyProtocol: true, SendProxyProtocol: "v1"}, false},
+	}
+
+	for _, c := range cases {
+		h := &StreamHandler{Config: c.Config}
+		if err := h.Load(); (err != nil) != c.Error {
+			t.Errorf("StreamHandler.Load(%+v) error must be %v, not %+v", c.Config.Listen, c.Error, err)
+		}
+	}
+}
@@ -173,7 +173,7 @@ func (h *TunnelHandler) wstunnel(ctx context.Context, dialer string) (net.Listen
 	host, port, ech := u.Hostname(), u.Port(), []byte{}
 	if u.Query().Get("ech") == "true" {
 		https, err := h.Resolver.LookupHTTPS(ctx, host)
-		log.Debug().Str("dns_server", h.Resolver.Addr).Interface("https", https).AnErr("error", err).Msg("lookup https records")
+		log.Debug().Str("dns_server", h.Resolver.Server()).Interface("https", https).AnErr("error", err).Msg("lookup https records")
 		if len(https) == 0 && err == nil {
 			err = fmt.Errorf("lookup https %v error: emtpy record", host)
 		}
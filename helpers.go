@@ -291,6 +291,7 @@ type TCPListener struct {
 	WriteBufferSize int
 	TLSConfig       *tls.Config
 	MirrorHeader    bool
+	ProxyProtocol   *ProxyProtocolConfig
 }
 
 func (ln TCPListener) Accept() (c net.Conn, err error) {
@@ -311,6 +312,10 @@ func (ln TCPListener) Accept() (c net.Conn, err error) {
 
 	c = tc
 
+	if ln.ProxyProtocol != nil && ln.ProxyProtocol.Trust(tc.RemoteAddr()) {
+		c = &ProxyProtocolConn{Conn: c, Timeout: 5 * time.Second}
+	}
+
 	if ln.MirrorHeader {
 		c = &MirrorHeaderConn{Conn: c, Header: nil}
 	}
@@ -1026,3 +1031,84 @@ func AppendToLower(dst []byte, s string) []byte {
 	}
 	return dst
 }
+
+// DomainSet matches hosts against exact ("example.com"), suffix (".example.com", the domain and
+// its subdomains) and wildcard ("*.example.com", subdomains only) entries with one map lookup per label.
+type DomainSet struct {
+	exact    map[string]struct{}
+	suffix   map[string]struct{}
+	wildcard map[string]struct{}
+}
+
+func (s *DomainSet) Contains(host string) bool {
+	if s == nil {
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, ok := s.exact[host]; ok {
+		return true
+	}
+	if _, ok := s.suffix[host]; ok {
+		return true
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if _, ok := s.suffix[host]; ok {
+			return true
+		}
+		if _, ok := s.wildcard[host]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *DomainSet) Len() int {
+	return len(s.exact) + len(s.suffix) + len(s.wildcard)
+}
+
+// DomainSetUnmarshal parses one domain per line into *DomainSet, only the first csv column is used.
+func DomainSetUnmarshal(data []byte, v any) error {
+	return unmarshalDomainSet(AppendSplitLines(nil, b2s(data)), v)
+}
+
+// DomainSetCsvUnmarshal parses a csv table into *DomainSet, the first row is the header and only the first column is used.
+func DomainSetCsvUnmarshal(data []byte, v any) error {
+	lines := AppendSplitLines(nil, b2s(data))
+	if len(lines) == 0 {
+		return fmt.Errorf("no csv header: %s", data)
+	}
+	return unmarshalDomainSet(lines[1:], v)
+}
+
+func unmarshalDomainSet(lines []string, v any) error {
+	set, ok := v.(*DomainSet)
+	if !ok {
+		return fmt.Errorf("*DomainSet required, found %T", v)
+	}
+	set.exact = make(map[string]struct{})
+	set.suffix = make(map[string]struct{})
+	set.wildcard = make(map[string]struct{})
+	for _, line := range lines {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if i := strings.IndexByte(line, ','); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(line), "."))
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "*."):
+			set.wildcard[line[2:]] = struct{}{}
+		case strings.HasPrefix(line, "."):
+			set.suffix[line[1:]] = struct{}{}
+		default:
+			set.exact[line] = struct{}{}
+		}
+	}
+	return nil
+}
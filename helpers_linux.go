@@ -22,12 +22,16 @@ const (
 	SO_MAX_PACING_RATE      = 47
 	TCP_FASTOPEN            = 23
 	IP_BIND_ADDRESS_NO_PORT = 24
+	IP_TRANSPARENT          = 19
+	IPV6_TRANSPARENT        = 75
+	SO_ORIGINAL_DST         = 80
 )
 
 type ListenConfig struct {
 	ReusePort   bool
 	FastOpen    bool
 	DeferAccept bool
+	Transparent bool
 }
 
 func (lc ListenConfig) Listen(ctx context.Context, network, address string) (net.Listener, error) {
@@ -43,6 +47,11 @@ func (lc ListenConfig) Listen(ctx context.Context, network, address string) (net
 				if lc.DeferAccept {
 					syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, 1)
 				}
+				if lc.Transparent {
+					// tproxy sockets accept connections to any address, the original destination is the local address
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IP, IP_TRANSPARENT, 1)
+					syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+				}
 			})
 		},
 	}
@@ -177,6 +186,38 @@ func SetTcpMaxPacingRate(tc *net.TCPConn, rate int) (err error) {
 	return
 }
 
+// GetOriginalDst returns the destination of a connection redirected by iptables REDIRECT.
+func GetOriginalDst(tc *net.TCPConn) (addr netip.AddrPort, err error) {
+	var c syscall.RawConn
+	c, err = tc.SyscallConn()
+	if err != nil {
+		return
+	}
+	c.Control(func(fd uintptr) {
+		// IP6T_SO_ORIGINAL_DST shares the value of SO_ORIGINAL_DST
+		if ip := AddrPortOf(tc.LocalAddr()).Addr(); ip.Is4() || ip.Is4In6() {
+			var sa syscall.RawSockaddrInet4
+			size := uint32(unsafe.Sizeof(sa))
+			if _, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_IP, SO_ORIGINAL_DST, uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+				err = os.NewSyscallError("getsockopt SOL_IP SO_ORIGINAL_DST", errno)
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+			addr = netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(port[0])<<8|uint16(port[1]))
+		} else {
+			var sa syscall.RawSockaddrInet6
+			size := uint32(unsafe.Sizeof(sa))
+			if _, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_IPV6, SO_ORIGINAL_DST, uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+				err = os.NewSyscallError("getsockopt SOL_IPV6 IP6T_SO_ORIGINAL_DST", errno)
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+			addr = netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(port[0])<<8|uint16(port[1]))
+		}
+	})
+	return
+}
+
 func RedirectStderrTo(file *os.File) error {
 	return syscall.Dup3(int(file.Fd()), 2, 0)
 }
@@ -7,6 +7,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"net/netip"
 	"syscall"
 )
 
@@ -14,6 +15,7 @@ type ListenConfig struct {
 	ReusePort   bool
 	FastOpen    bool
 	DeferAccept bool
+	Transparent bool
 }
 
 func (ln ListenConfig) Listen(ctx context.Context, network, address string) (net.Listener, error) {
@@ -45,6 +47,10 @@ func SetTcpMaxPacingRate(tc *net.TCPConn, rate int) (err error) {
 	return nil
 }
 
+func GetOriginalDst(tc *net.TCPConn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("not implemented")
+}
+
 func SetProcessName(name string) error {
 	return nil
 }
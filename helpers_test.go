@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDomainSet(t *testing.T) {
+	data := "domain,comment\nexample.com\n.example.org, suffix\n*.example.net # wildcard\nUPPER.example.io.\n\n# comment\n"
+
+	var set DomainSet
+	if err := DomainSetCsvUnmarshal([]byte(data), &set); err != nil {
+		t.Fatalf("DomainSetCsvUnmarshal error: %+v", err)
+	}
+	if n := set.Len(); n != 4 {
+		t.Errorf("DomainSet.Len() must return 4, not %d", n)
+	}
+
+	cases := []struct {
+		Host     string
+		Contains bool
+	}{
+		{"example.com", true},
+		{"Example.COM.", true},
+		{"www.example.com", false},
+		{"example.org", true},
+		{"www.example.org", true},
+		{"a.b.example.org", true},
+		{"badexample.org", false},
+		{"example.net", false},
+		{"www.example.net", true},
+		{"a.b.example.net", true},
+		{"upper.example.io", true},
+		{"domain", false},
+		{"example.io", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if got := set.Contains(c.Host); got != c.Contains {
+			t.Errorf("DomainSet.Contains(%#v) must return %v, not %v", c.Host, c.Contains, got)
+		}
+	}
+
+	// inline lists have no header, the first line is a domain
+	var names DomainSet
+	if err := DomainSetUnmarshal([]byte("example.com\n*.example.net"), &names); err != nil || !names.Contains("example.com") || names.Len() != 2 {
+		t.Errorf("DomainSetUnmarshal must keep the first line, not len=%d err=%+v", names.Len(), err)
+	}
+
+	if (*DomainSet)(nil).Contains("example.com") {
+		t.Errorf("nil DomainSet must not contain any host")
+	}
+}
+
+func TestDomainSetCsvSample(t *testing.T) {
+	data, err := os.ReadFile("deny_domains.csv")
+	if err != nil {
+		t.Fatalf("read deny_domains.csv error: %+v", err)
+	}
+
+	var set DomainSet
+	if err := DomainSetCsvUnmarshal(data, &set); err != nil {
+		t.Fatalf("DomainSetCsvUnmarshal error: %+v", err)
+	}
+
+	cases := []struct {
+		Host     string
+		Contains bool
+	}{
+		{"domain", false},
+		{"example.com", true},
+		{"www.example.com", false},
+		{"doubleclick.net", true},
+		{"ad.doubleclick.net", true},
+		{"ads.example.org", false},
+		{"x.ads.example.org", true},
+	}
+
+	for _, c := range cases {
+		if got := set.Contains(c.Host); got != c.Contains {
+			t.Errorf("deny_domains.csv Contains(%#v) must return %v, not %v", c.Host, c.Contains, got)
+		}
+	}
+}
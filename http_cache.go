@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/phuslu/lru"
+)
+
+// HTTPCache is a shared RFC 9111 cache for GET responses. Entries are kept in a memory LRU, and their
+// bodies are stored under Dir when it is set, so that large responses and restarts are survived.
+type HTTPCache struct {
+	MemorySize   int
+	Dir          string
+	MaxSize      int64
+	MaxEntrySize int64
+
+	memory   *lru.LRUCache[string, *HTTPCacheEntry]
+	group    singleflight_Group[string, *HTTPCacheEntry]
+	diskSize atomic.Int64
+	pruning  atomic.Bool
+}
+
+// HTTPCacheEntry is a stored response. An entry with zero StatusCode only records the Vary header of a key,
+// its variants are stored under the keys returned by HTTPCacheVaryKey.
+type HTTPCacheEntry struct {
+	Key          string      `json:"key"`
+	StatusCode   int         `json:"status_code"`
+	Header       http.Header `json:"header"`
+	VaryHeader   http.Header `json:"vary_header"`
+	RequestTime  time.Time   `json:"request_time"`
+	ResponseTime time.Time   `json:"response_time"`
+	Size         int64       `json:"size"`
+	BodyFile     string      `json:"body_file"`
+	Body         []byte      `json:"-"`
+}
+
+func (c *HTTPCache) Load() error {
+	c.memory = lru.NewLRUCache[string, *HTTPCacheEntry](cmp.Or(c.MemorySize, 1024))
+
+	if c.Dir == "" {
+		c.MaxEntrySize = cmp.Or(c.MaxEntrySize, 1<<20)
+		return nil
+	}
+
+	c.MaxEntrySize = cmp.Or(c.MaxEntrySize, 64<<20)
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry.Name(), "tmp-"):
+			os.Remove(filepath.Join(c.Dir, entry.Name()))
+		case strings.HasSuffix(entry.Name(), ".body"):
+			if fi, err := entry.Info(); err == nil {
+				c.diskSize.Add(fi.Size())
+			}
+		}
+	}
+
+	return nil
+}
+
+// RoundTrip serves req from the cache under key, next is called for misses, revalidations and requests which
+// must bypass the cache. Concurrent misses of the same key are collapsed into one upstream request.
+// The returned status is one of HIT, STALE, REVALIDATED, EXPIRED, MISS and BYPASS.
+func (c *HTTPCache) RoundTrip(req *http.Request, key string, next func(*http.Request) (*http.Response, error)) (*http.Response, string, error) {
+	reqcc := ParseCacheControl(req.Header)
+	if _, ok := reqcc["no-store"]; ok || req.Method != http.MethodGet || req.Header.Get("range") != "" {
+		resp, err := next(req)
+		return resp, "BYPASS", err
+	}
+
+	now := time.Now()
+	status := "MISS"
+
+	entry := c.lookup(key, req)
+	if entry != nil {
+		age, lifetime := entry.Age(now), entry.Lifetime()
+		respcc := ParseCacheControl(entry.Header)
+
+		_, nocache := reqcc["no-cache"]
+		if _, ok := respcc["no-cache"]; ok {
+			nocache = true
+		}
+		if _, ok := reqcc["max-age"]; ok && age > reqcc.Seconds("max-age") {
+			nocache = true
+		}
+
+		_, mustRevalidate := respcc["must-revalidate"]
+		swr := respcc.Seconds("stale-while-revalidate")
+
+		switch {
+		case !nocache && age < lifetime:
+			if resp, err := c.serve(req, entry, now); err == nil {
+				return resp, "HIT", nil
+			}
+			entry = nil
+		case !nocache && !mustRevalidate && age < lifetime+swr:
+			if resp, err := c.serve(req, entry, now); err == nil {
+				c.revalidate(req, key, entry, next)
+				return resp, "STALE", nil
+			}
+			entry = nil
+		default:
+			status = "EXPIRED"
+		}
+	}
+
+	if _, ok := reqcc["only-if-cached"]; ok {
+		return &http.Response{
+			StatusCode: http.StatusGatewayTimeout,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+			Request:    req,
+		}, status, nil
+	}
+
+	var ran bool
+	var live *http.Response
+	fetched, err, _ := c.group.Do(key, func() (*HTTPCacheEntry, error) {
+		ran = true
+		e, resp, revalidated, err := c.fetch(req, key, entry, next)
+		if revalidated {
+			status = "REVALIDATED"
+		}
+		live = resp
+		return e, err
+	})
+
+	switch {
+	case ran && err != nil:
+		return nil, status, err
+	case ran && live != nil:
+		return live, status, nil
+	case !ran && (err != nil || fetched == nil || !fetched.Matches(req)):
+		// the collapsed request was not cacheable for this client, fetch it alone
+		resp, err := next(req)
+		return resp, status, err
+	case !ran:
+		status = "HIT"
+	}
+
+	resp, err := c.serve(req, fetched, time.Now())
+	if err != nil {
+		resp, err = next(req)
+	}
+
+	return resp, status, err
+}
+
+// lookup returns the stored response of key which matches the Vary header of req.
+func (c *HTTPCache) lookup(key string, req *http.Request) *HTTPCacheEntry {
+	entry := c.get(key)
+	if entry != nil && entry.StatusCode == 0 {
+		entry = c.get(HTTPCacheVaryKey(key, entry.Header.Values("vary"), req.Header))
+	}
+	if entry != nil && !entry.Matches(req) {
+		return nil
+	}
+	return entry
+}
+
+func (c *HTTPCache) get(key string) *HTTPCacheEntry {
+	if entry, ok := c.memory.Get(key); ok {
+		return entry
+	}
+
+	if c.Dir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.path(key, ".json"))
+	if err != nil {
+		return nil
+	}
+
+	entry := new(HTTPCacheEntry)
+	if err := json.Unmarshal(data, entry); err != nil || entry.Key != key {
+		return nil
+	}
+	c.memory.Set(key, entry)
+
+	return entry
+}
+
+// fetch requests the origin, revalidating entry if it has validators. It returns the stored entry of a
+// cacheable response, or the live response otherwise.
+func (c *HTTPCache) fetch(req *http.Request, key string, entry *HTTPCacheEntry, next func(*http.Request) (*http.Response, error)) (stored *HTTPCacheEntry, live *http.Response, revalidated bool, err error) {
+	outreq := req.Clone(req.Context())
+	// conditionals of the client are answered from the cache
+	for _, name := range []string{"if-none-match", "if-modified-since", "if-match", "if-unmodified-since", "if-range"} {
+		outreq.Header.Del(name)
+	}
+	if entry != nil {
+		if etag := entry.Header.Get("etag"); etag != "" {
+			outreq.Header.Set("if-none-match", etag)
+		}
+		if lastModified := entry.Header.Get("last-modified"); lastModified != "" {
+			outreq.Header.Set("if-modified-since", lastModified)
+		}
+	}
+
+	requestTime := time.Now()
+	resp, err := next(outreq)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	responseTime := time.Now()
+
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		updated := *entry
+		updated.Header = entry.Header.Clone()
+		for name, values := range resp.Header {
+			if !slices.Contains([]string{"Content-Length", "Content-Encoding", "Content-Type", "Transfer-Encoding"}, name) {
+				updated.Header[name] = values
+			}
+		}
+		updated.RequestTime, updated.ResponseTime = requestTime, responseTime
+		return &updated, nil, true, c.save(&updated)
+	}
+
+	if !c.storable(req, resp) {
+		return nil, resp, false, nil
+	}
+
+	stored = &HTTPCacheEntry{
+		Key:          key,
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Trailer"} {
+		stored.Header.Del(name)
+	}
+	if vary := resp.Header.Values("vary"); len(vary) > 0 {
+		stored.Key = HTTPCacheVaryKey(key, vary, req.Header)
+		stored.VaryHeader = http.Header{}
+		for _, name := range HTTPCacheVaryNames(vary) {
+			if values := req.Header.Values(name); len(values) > 0 {
+				stored.VaryHeader[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+	}
+
+	body, err := c.saveBody(stored, resp.Body)
+	if body != nil {
+		// the body exceeds max_entry_size, hand over the consumed part and the rest
+		resp.Body = body
+		return nil, resp, false, nil
+	}
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if stored.Key != key {
+		stub := &HTTPCacheEntry{Key: key, Header: http.Header{"Vary": resp.Header.Values("vary")}}
+		if err := c.save(stub); err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	if err := c.save(stored); err != nil {
+		if stored.BodyFile != "" {
+			os.Remove(filepath.Join(c.Dir, stored.BodyFile))
+			c.diskSize.Add(-stored.Size)
+		}
+		return nil, nil, false, err
+	}
+
+	return stored, nil, false, nil
+}
+
+// revalidate refreshes a stale entry in background.
+func (c *HTTPCache) revalidate(req *http.Request, key string, entry *HTTPCacheEntry, next func(*http.Request) (*http.Response, error)) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), time.Minute)
+	req = req.Clone(ctx)
+
+	go func() {
+		defer cancel()
+		c.group.Do(key, func() (*HTTPCacheEntry, error) {
+			e, resp, _, err := c.fetch(req, key, entry, next)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if err != nil {
+				log.Warn().Err(err).Str("cache_key", key).Msg("http cache revalidate error")
+			}
+			return e, err
+		})
+	}()
+}
+
+// storable reports whether resp of req may be stored by a shared cache.
+func (c *HTTPCache) storable(req *http.Request, resp *http.Response) bool {
+	respcc := ParseCacheControl(resp.Header)
+	if _, ok := respcc["no-store"]; ok {
+		return false
+	}
+	if _, ok := respcc["private"]; ok {
+		return false
+	}
+
+	if _, ok := ParseCacheControl(req.Header)["no-store"]; ok {
+		return false
+	}
+
+	if req.Header.Get("authorization") != "" {
+		_, public := respcc["public"]
+		_, smaxage := respcc["s-maxage"]
+		_, mustRevalidate := respcc["must-revalidate"]
+		if !public && !smaxage && !mustRevalidate {
+			return false
+		}
+	}
+
+	if slices.Contains(HTTPCacheVaryNames(resp.Header.Values("vary")), "*") {
+		return false
+	}
+
+	if resp.Header.Get("set-cookie") != "" || resp.Header.Get("content-range") != "" {
+		return false
+	}
+
+	if resp.ContentLength > c.MaxEntrySize {
+		return false
+	}
+
+	entry := &HTTPCacheEntry{StatusCode: resp.StatusCode, Header: resp.Header, ResponseTime: time.Now()}
+	switch resp.StatusCode {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+		// heuristically cacheable
+	case 302, 307:
+		if !entry.HasExplicitLifetime() {
+			return false
+		}
+	default:
+		return false
+	}
+
+	return entry.Lifetime() > 0 || resp.Header.Get("etag") != "" || resp.Header.Get("last-modified") != ""
+}
+
+// serve builds the response of entry for req, answering its conditional headers.
+func (c *HTTPCache) serve(req *http.Request, entry *HTTPCacheEntry, now time.Time) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.Header.Clone(),
+		ContentLength: entry.Size,
+		Request:       req,
+	}
+	resp.Header.Set("age", strconv.FormatInt(int64(entry.Age(now)/time.Second), 10))
+	resp.Header.Set("content-length", strconv.FormatInt(entry.Size, 10))
+
+	if entry.StatusCode == http.StatusOK && entry.NotModified(req) {
+		resp.StatusCode, resp.ContentLength, resp.Body = http.StatusNotModified, 0, http.NoBody
+		resp.Header.Del("content-length")
+		return resp, nil
+	}
+
+	if c.Dir == "" {
+		resp.Body = io.NopCloser(bytes.NewReader(entry.Body))
+		return resp, nil
+	}
+
+	// each body has its own file, a concurrent refresh never swaps the body of entry
+	if entry.BodyFile == "" {
+		c.memory.Delete(entry.Key)
+		return nil, os.ErrNotExist
+	}
+	filename := filepath.Join(c.Dir, entry.BodyFile)
+	file, err := os.Open(filename)
+	if err != nil {
+		c.memory.Delete(entry.Key)
+		return nil, err
+	}
+	// body files are pruned by modification time
+	os.Chtimes(filename, now, now)
+	resp.Body = file
+
+	return resp, nil
+}
+
+// saveBody stores the body of entry. If the body exceeds max_entry_size, nothing is stored and the returned
+// reader replays the consumed part followed by the rest of body.
+func (c *HTTPCache) saveBody(entry *HTTPCacheEntry, body io.ReadCloser) (io.ReadCloser, error) {
+	if c.Dir == "" {
+		var b bytes.Buffer
+		n, err := io.Copy(&b, io.LimitReader(body, c.MaxEntrySize+1))
+		if err != nil {
+			return nil, err
+		}
+		if n > c.MaxEntrySize {
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(&b, body), body}, nil
+		}
+		entry.Body, entry.Size = b.Bytes(), n
+		return nil, nil
+	}
+
+	file, err := os.CreateTemp(c.Dir, "tmp-")
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := io.Copy(file, io.LimitReader(body, c.MaxEntrySize+1))
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	if n > c.MaxEntrySize {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(file, body), closerFunc(func() error {
+			file.Close()
+			os.Remove(file.Name())
+			return body.Close()
+		})}, nil
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	filename := c.path(entry.Key, "."+log.NewXID().String()+".body")
+	if err := os.Rename(file.Name(), filename); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	entry.Size, entry.BodyFile = n, filepath.Base(filename)
+
+	if size := c.diskSize.Add(n); c.MaxSize > 0 && size > c.MaxSize && c.pruning.CompareAndSwap(false, true) {
+		go c.prune()
+	}
+
+	return nil, nil
+}
+
+// save stores entry into memory, and its metadata into Dir. The body file of the replaced entry is removed,
+// readers which opened it keep reading the old body.
+func (c *HTTPCache) save(entry *HTTPCacheEntry) error {
+	if c.Dir == "" {
+		c.memory.Set(entry.Key, entry)
+		return nil
+	}
+
+	prev := c.get(entry.Key)
+	c.memory.Set(entry.Key, entry)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(c.Dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), c.path(entry.Key, ".json"))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if prev != nil && prev.BodyFile != "" && prev.BodyFile != entry.BodyFile {
+		if os.Remove(filepath.Join(c.Dir, prev.BodyFile)) == nil {
+			c.diskSize.Add(-prev.Size)
+		}
+	}
+
+	return nil
+}
+
+// prune removes the least recently used bodies until the disk usage drops below 90% of max_size.
+func (c *HTTPCache) prune() {
+	defer c.pruning.Store(false)
+
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		log.Error().Err(err).Str("cache_dir", c.Dir).Msg("http cache prune error")
+		return
+	}
+
+	type body struct {
+		name    string
+		size    int64
+		modtime time.Time
+	}
+
+	var bodies []body
+	var total int64
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".body") {
+			continue
+		}
+		if fi, err := entry.Info(); err == nil {
+			bodies = append(bodies, body{entry.Name(), fi.Size(), fi.ModTime()})
+			total += fi.Size()
+		}
+	}
+
+	slices.SortFunc(bodies, func(a, b body) int { return a.modtime.Compare(b.modtime) })
+
+	var removed int
+	for _, b := range bodies {
+		if total <= c.MaxSize/10*9 {
+			break
+		}
+		// bodies are named <sha256 of key>.<xid>.body next to <sha256 of key>.json
+		prefix, _, _ := strings.Cut(b.name, ".")
+		os.Remove(filepath.Join(c.Dir, prefix+".json"))
+		if os.Remove(filepath.Join(c.Dir, b.name)) == nil {
+			total -= b.size
+			removed++
+		}
+	}
+	c.diskSize.Store(total)
+
+	log.Info().Str("cache_dir", c.Dir).Int("cache_removed", removed).Int64("cache_disk_size", total).Msg("http cache prune ok")
+}
+
+func (c *HTTPCache) path(key, ext string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:])+ext)
+}
+
+// Matches reports whether the request headers nominated by Vary equal to the stored ones.
+func (e *HTTPCacheEntry) Matches(req *http.Request) bool {
+	for _, name := range HTTPCacheVaryNames(e.Header.Values("vary")) {
+		if !slices.Equal(e.VaryHeader.Values(name), req.Header.Values(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasExplicitLifetime reports whether the response carries s-maxage, max-age or Expires.
+func (e *HTTPCacheEntry) HasExplicitLifetime() bool {
+	cc := ParseCacheControl(e.Header)
+	_, smaxage := cc["s-maxage"]
+	_, maxage := cc["max-age"]
+	return smaxage || maxage || e.Header.Get("expires") != ""
+}
+
+// Lifetime returns the freshness lifetime for a shared cache, see RFC 9111 section 4.2.1.
+func (e *HTTPCacheEntry) Lifetime() time.Duration {
+	cc := ParseCacheControl(e.Header)
+	if _, ok := cc["s-maxage"]; ok {
+		return cc.Seconds("s-maxage")
+	}
+	if _, ok := cc["max-age"]; ok {
+		return cc.Seconds("max-age")
+	}
+
+	date := e.ResponseTime
+	if t, err := http.ParseTime(e.Header.Get("date")); err == nil {
+		date = t
+	}
+
+	if s := e.Header.Get("expires"); s != "" {
+		// an invalid expires means already expired
+		if t, err := http.ParseTime(s); err == nil && t.After(date) {
+			return t.Sub(date)
+		}
+		return 0
+	}
+
+	// heuristic freshness is 10% of the time since last modification, at most one day
+	if t, err := http.ParseTime(e.Header.Get("last-modified")); err == nil && t.Before(date) {
+		return min(date.Sub(t)/10, 24*time.Hour)
+	}
+
+	return 0
+}
+
+// Age returns the current age of the entry, see RFC 9111 section 4.2.3.
+func (e *HTTPCacheEntry) Age(now time.Time) time.Duration {
+	var apparent time.Duration
+	if t, err := http.ParseTime(e.Header.Get("date")); err == nil {
+		apparent = max(0, e.ResponseTime.Sub(t))
+	}
+
+	var value time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("age"), 10, 64); err == nil && n > 0 {
+		value = time.Duration(n) * time.Second
+	}
+
+	corrected := value + e.ResponseTime.Sub(e.RequestTime)
+
+	return max(apparent, corrected) + now.Sub(e.ResponseTime)
+}
+
+// NotModified evaluates If-None-Match and If-Modified-Since of req against the entry.
+func (e *HTTPCacheEntry) NotModified(req *http.Request) bool {
+	if inm := req.Header.Get("if-none-match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, s := range strings.Split(inm, ",") {
+			if s = strings.TrimSpace(s); s == "*" || strings.TrimPrefix(s, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims, err := http.ParseTime(req.Header.Get("if-modified-since")); err == nil {
+		if lm, err := http.ParseTime(e.Header.Get("last-modified")); err == nil {
+			return !lm.After(ims)
+		}
+	}
+
+	return false
+}
+
+// HTTPCacheVaryNames returns the lower-cased header names of Vary values.
+func HTTPCacheVaryNames(vary []string) (names []string) {
+	for _, value := range vary {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return
+}
+
+// HTTPCacheVaryKey returns the secondary cache key of key for the request headers nominated by Vary.
+func HTTPCacheVaryKey(key string, vary []string, header http.Header) string {
+	var sb strings.Builder
+	sb.WriteString(key)
+	for _, name := range HTTPCacheVaryNames(vary) {
+		sb.WriteByte(0)
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return sb.String()
+}
+
+// CacheControl holds the lower-cased directives of Cache-Control, and Pragma: no-cache.
+type CacheControl map[string]string
+
+func ParseCacheControl(header http.Header) CacheControl {
+	cc := CacheControl{}
+	for _, value := range header.Values("cache-control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name = strings.ToLower(name); name != "" {
+				cc[name] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	if len(cc) == 0 && strings.Contains(strings.ToLower(header.Get("pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+// Seconds returns the delta-seconds argument of directive, or zero if absent or invalid.
+func (cc CacheControl) Seconds(directive string) time.Duration {
+	n, err := strconv.ParseInt(cc[directive], 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
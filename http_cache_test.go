@@ -0,0 +1,384 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newHTTPCacheTestResponse(status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func newHTTPCacheTest(t *testing.T, c *HTTPCache) *HTTPCache {
+	if err := c.Load(); err != nil {
+		t.Fatalf("HTTPCache.Load error: %+v", err)
+	}
+	return c
+}
+
+// roundTripHTTPCacheTest sends a GET of key through c and returns the cache status and the response body.
+func roundTripHTTPCacheTest(t *testing.T, c *HTTPCache, key string, header http.Header, next func(*http.Request) (*http.Response, error)) (string, *http.Response, string) {
+	req := httptest.NewRequest(http.MethodGet, key, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, status, err := c.RoundTrip(req, key, next)
+	if err != nil {
+		t.Fatalf("HTTPCache.RoundTrip(%#v) error: %+v", key, err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("HTTPCache.RoundTrip(%#v) read body error: %+v", key, err)
+	}
+	return status, resp, string(body)
+}
+
+func TestHTTPCacheEntryLifetime(t *testing.T) {
+	date := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cases := []struct {
+		Header   http.Header
+		Lifetime time.Duration
+	}{
+		{http.Header{"Cache-Control": {"s-maxage=60, max-age=10"}}, 60 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=10"}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, 10 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=-1"}}, 0},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(30 * time.Second).Format(http.TimeFormat)}}, 30 * time.Second},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {"0"}}, 0},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(-time.Hour).Format(http.TimeFormat)}}, 0},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Last-Modified": {date.Add(-100 * time.Hour).Format(http.TimeFormat)}}, 10 * time.Hour},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Last-Modified": {date.Add(-100 * 24 * time.Hour).Format(http.TimeFormat)}}, 24 * time.Hour},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}}, 0},
+	}
+
+	for _, c := range cases {
+		entry := &HTTPCacheEntry{StatusCode: 200, Header: c.Header, ResponseTime: date}
+		if lifetime := entry.Lifetime(); lifetime != c.Lifetime {
+			t.Errorf("HTTPCacheEntry.Lifetime(%v) must return %s, not %s", c.Header, c.Lifetime, lifetime)
+		}
+	}
+}
+
+func TestHTTPCacheEntryAge(t *testing.T) {
+	requestTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	responseTime := requestTime.Add(2 * time.Second)
+	now := responseTime.Add(10 * time.Second)
+
+	cases := []struct {
+		Header http.Header
+		Age    time.Duration
+	}{
+		{http.Header{}, 12 * time.Second},
+		{http.Header{"Date": {responseTime.Add(-5 * time.Second).Format(http.TimeFormat)}}, 15 * time.Second},
+		{http.Header{"Date": {responseTime.Add(time.Minute).Format(http.TimeFormat)}}, 12 * time.Second},
+		{http.Header{"Age": {"30"}}, 42 * time.Second},
+		{http.Header{"Age": {"30"}, "Date": {responseTime.Add(-time.Minute).Format(http.TimeFormat)}}, 70 * time.Second},
+		{http.Header{"Age": {"-30"}}, 12 * time.Second},
+	}
+
+	for _, c := range cases {
+		entry := &HTTPCacheEntry{StatusCode: 200, Header: c.Header, RequestTime: requestTime, ResponseTime: responseTime}
+		if age := entry.Age(now); age != c.Age {
+			t.Errorf("HTTPCacheEntry.Age(%v) must return %s, not %s", c.Header, c.Age, age)
+		}
+	}
+}
+
+func TestHTTPCacheStorable(t *testing.T) {
+	c := newHTTPCacheTest(t, &HTTPCache{MaxEntrySize: 1024})
+
+	cases := []struct {
+		Request    http.Header
+		StatusCode int
+		Response   http.Header
+		Length     int64
+		Storable   bool
+	}{
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, 10, true},
+		{nil, 200, http.Header{"Etag": {`"v1"`}}, 10, true},
+		{nil, 200, http.Header{"Last-Modified": {"Mon, 01 Jan 2024 00:00:00 GMT"}}, 10, true},
+		{nil, 200, http.Header{}, 10, false},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60, no-store"}}, 10, false},
+		{nil, 200, http.Header{"Cache-Control": {"private, max-age=60"}}, 10, false},
+		{http.Header{"Cache-Control": {"no-store"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, 10, false},
+		{http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, 10, false},
+		{http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, 10, true},
+		{http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, 200, http.Header{"Cache-Control": {"s-maxage=60"}}, 10, true},
+		{http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, 200, http.Header{"Cache-Control": {"must-revalidate, max-age=60"}}, 10, true},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, 10, false},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"accept-encoding, *"}}, 10, false},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"accept-encoding"}}, 10, true},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"sid=1"}}, 10, false},
+		{nil, 206, http.Header{"Cache-Control": {"max-age=60"}, "Content-Range": {"bytes 0-9/100"}}, 10, false},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, 2048, false},
+		{nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, -1, true},
+		{nil, 404, http.Header{"Cache-Control": {"max-age=60"}}, 10, true},
+		{nil, 302, http.Header{"Last-Modified": {"Mon, 01 Jan 2024 00:00:00 GMT"}}, 10, false},
+		{nil, 302, http.Header{"Cache-Control": {"max-age=60"}}, 10, true},
+		{nil, 500, http.Header{"Cache-Control": {"max-age=60"}}, 10, false},
+	}
+
+	for _, x := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for name, values := range x.Request {
+			req.Header[name] = values
+		}
+		resp := &http.Response{StatusCode: x.StatusCode, Header: x.Response, ContentLength: x.Length}
+		if storable := c.storable(req, resp); storable != x.Storable {
+			t.Errorf("HTTPCache.storable(%v, %d %v) must return %v, not %v", x.Request, x.StatusCode, x.Response, x.Storable, storable)
+		}
+	}
+}
+
+func TestHTTPCacheVary(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		c := newHTTPCacheTest(t, &HTTPCache{Dir: dir})
+
+		var fetches atomic.Int32
+		next := func(req *http.Request) (*http.Response, error) {
+			fetches.Add(1)
+			return newHTTPCacheTestResponse(200, http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Vary":          {"Accept-Encoding"},
+			}, "body of "+req.Header.Get("accept-encoding")), nil
+		}
+
+		cases := []struct {
+			AcceptEncoding string
+			Status         string
+			Fetches        int32
+		}{
+			{"gzip", "MISS", 1},
+			{"gzip", "HIT", 1},
+			{"br", "MISS", 2},
+			{"br", "HIT", 2},
+			{"gzip", "HIT", 2},
+		}
+
+		for _, x := range cases {
+			status, _, body := roundTripHTTPCacheTest(t, c, "http://example.org/vary", http.Header{"Accept-Encoding": {x.AcceptEncoding}}, next)
+			if status != x.Status || body != "body of "+x.AcceptEncoding || fetches.Load() != x.Fetches {
+				t.Errorf("HTTPCache(dir=%#v).RoundTrip(%s) must return %s %#v after %d fetches, not %s %#v after %d", dir, x.AcceptEncoding, x.Status, "body of "+x.AcceptEncoding, x.Fetches, status, body, fetches.Load())
+			}
+		}
+
+		// the primary key only records the vary header, the variants live under their secondary keys
+		stub := c.get("http://example.org/vary")
+		if stub == nil || stub.StatusCode != 0 || stub.Header.Get("vary") != "Accept-Encoding" {
+			t.Errorf("HTTPCache(dir=%#v) must store a vary stub, not %+v", dir, stub)
+		}
+		variant := c.get(HTTPCacheVaryKey("http://example.org/vary", []string{"Accept-Encoding"}, http.Header{"Accept-Encoding": {"br"}}))
+		if variant == nil || variant.StatusCode != 200 || variant.VaryHeader.Get("accept-encoding") != "br" {
+			t.Errorf("HTTPCache(dir=%#v) must store the br variant, not %+v", dir, variant)
+		}
+	}
+}
+
+func TestHTTPCacheRevalidate(t *testing.T) {
+	c := newHTTPCacheTest(t, &HTTPCache{Dir: t.TempDir()})
+
+	var conditional string
+	next := func(req *http.Request) (*http.Response, error) {
+		if conditional = req.Header.Get("if-none-match"); conditional == `"v1"` {
+			return newHTTPCacheTestResponse(http.StatusNotModified, http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Etag":          {`"v1"`},
+				"X-Version":     {"2"},
+				"Content-Type":  {"text/html"},
+			}, ""), nil
+		}
+		return newHTTPCacheTestResponse(200, http.Header{
+			"Cache-Control": {"max-age=0"},
+			"Content-Type":  {"text/plain"},
+			"Etag":          {`"v1"`},
+			"X-Version":     {"1"},
+		}, "hello"), nil
+	}
+
+	cases := []struct {
+		Status      string
+		Conditional string
+		Version     string
+	}{
+		{"MISS", "", "1"},
+		{"REVALIDATED", `"v1"`, "2"},
+		{"HIT", `"v1"`, "2"},
+	}
+
+	for _, x := range cases {
+		status, resp, body := roundTripHTTPCacheTest(t, c, "http://example.org/etag", nil, next)
+		if status != x.Status || conditional != x.Conditional || body != "hello" || resp.Header.Get("x-version") != x.Version {
+			t.Errorf("HTTPCache.RoundTrip must return %s %#v x-version=%s with if-none-match %#v, not %s %#v x-version=%s with %#v", x.Status, "hello", x.Version, x.Conditional, status, body, resp.Header.Get("x-version"), conditional)
+		}
+		// the 304 must not replace the stored representation headers
+		if ct := resp.Header.Get("content-type"); ct != "text/plain" {
+			t.Errorf("HTTPCache.RoundTrip(%s) must keep content-type text/plain, not %#v", x.Status, ct)
+		}
+	}
+
+	// conditionals of the client are answered from the cache
+	status, resp, _ := roundTripHTTPCacheTest(t, c, "http://example.org/etag", http.Header{"If-None-Match": {`W/"v1"`}}, next)
+	if status != "HIT" || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("HTTPCache.RoundTrip(if-none-match) must return HIT 304, not %s %d", status, resp.StatusCode)
+	}
+}
+
+func TestHTTPCacheStaleWhileRevalidate(t *testing.T) {
+	c := newHTTPCacheTest(t, &HTTPCache{})
+
+	var version atomic.Int32
+	next := func(req *http.Request) (*http.Response, error) {
+		v := version.Add(1)
+		header := http.Header{"Cache-Control": {"max-age=60"}}
+		if v == 1 {
+			header = http.Header{"Cache-Control": {"max-age=1, stale-while-revalidate=60"}, "Age": {"5"}}
+		}
+		return newHTTPCacheTestResponse(200, header, "v"+strconv.Itoa(int(v))), nil
+	}
+
+	if status, _, body := roundTripHTTPCacheTest(t, c, "http://example.org/swr", nil, next); status != "MISS" || body != "v1" {
+		t.Fatalf("HTTPCache.RoundTrip must return MISS \"v1\", not %s %#v", status, body)
+	}
+	if status, _, body := roundTripHTTPCacheTest(t, c, "http://example.org/swr", nil, next); status != "STALE" || body != "v1" {
+		t.Fatalf("HTTPCache.RoundTrip must return STALE \"v1\", not %s %#v", status, body)
+	}
+
+	// wait for the background revalidation
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if entry := c.get("http://example.org/swr"); entry != nil && string(entry.Body) == "v2" {
+			break
+		}
+	}
+
+	if status, _, body := roundTripHTTPCacheTest(t, c, "http://example.org/swr", nil, next); status != "HIT" || body != "v2" {
+		t.Errorf("HTTPCache.RoundTrip must return the revalidated HIT \"v2\", not %s %#v", status, body)
+	}
+
+	// must-revalidate forbids serving stale
+	c = newHTTPCacheTest(t, &HTTPCache{})
+	version.Store(0)
+	next = func(req *http.Request) (*http.Response, error) {
+		version.Add(1)
+		return newHTTPCacheTestResponse(200, http.Header{"Cache-Control": {"max-age=1, stale-while-revalidate=60, must-revalidate"}, "Age": {"5"}}, "must"), nil
+	}
+	roundTripHTTPCacheTest(t, c, "http://example.org/must", nil, next)
+	if status, _, _ := roundTripHTTPCacheTest(t, c, "http://example.org/must", nil, next); status != "EXPIRED" {
+		t.Errorf("HTTPCache.RoundTrip(must-revalidate) must return EXPIRED, not %s", status)
+	}
+}
+
+func TestHTTPCacheMaxEntrySize(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		c := newHTTPCacheTest(t, &HTTPCache{Dir: dir, MaxEntrySize: 16})
+
+		data := strings.Repeat("0123456789", 10)
+		next := func(req *http.Request) (*http.Response, error) {
+			resp := newHTTPCacheTestResponse(200, http.Header{"Cache-Control": {"max-age=60"}}, data)
+			// unknown length, the limit is found while storing
+			resp.ContentLength = -1
+			return resp, nil
+		}
+
+		for range 2 {
+			status, _, body := roundTripHTTPCacheTest(t, c, "http://example.org/large", nil, next)
+			if status != "MISS" || body != data {
+				t.Errorf("HTTPCache(dir=%#v).RoundTrip must hand over the whole large body as MISS, not %s %d bytes", dir, status, len(body))
+			}
+		}
+
+		if dir != "" {
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("HTTPCache(dir=%#v) must not leave files of a large body, not %d", dir, len(entries))
+			}
+		}
+	}
+}
+
+func TestHTTPCachePrune(t *testing.T) {
+	dir := t.TempDir()
+	c := newHTTPCacheTest(t, &HTTPCache{Dir: dir, MaxSize: 250})
+
+	next := func(req *http.Request) (*http.Response, error) {
+		return newHTTPCacheTestResponse(200, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("x", 100)), nil
+	}
+
+	for i := range 3 {
+		roundTripHTTPCacheTest(t, c, "http://example.org/"+strconv.Itoa(i), nil, next)
+		// prune goes by modification time
+		matches, _ := filepath.Glob(c.path("http://example.org/"+strconv.Itoa(i), ".*.body"))
+		for _, name := range matches {
+			mtime := time.Now().Add(time.Duration(i-10) * time.Minute)
+			os.Chtimes(name, mtime, mtime)
+		}
+	}
+
+	for deadline := time.Now().Add(time.Second); c.diskSize.Load() > 225 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size := c.diskSize.Load(); size != 200 {
+		t.Fatalf("HTTPCache.prune must shrink the disk size to 200, not %d", size)
+	}
+
+	for i, exists := range []bool{false, true, true} {
+		key := "http://example.org/" + strconv.Itoa(i)
+		if _, err := os.Stat(c.path(key, ".json")); (err == nil) != exists {
+			t.Errorf("HTTPCache.prune must keep=%v the entry of %#v, err=%+v", exists, key, err)
+		}
+	}
+}
+
+func TestHTTPCacheBodyReplaced(t *testing.T) {
+	dir := t.TempDir()
+	c := newHTTPCacheTest(t, &HTTPCache{Dir: dir})
+
+	var version atomic.Int32
+	next := func(req *http.Request) (*http.Response, error) {
+		v := strconv.Itoa(int(version.Add(1)))
+		return newHTTPCacheTestResponse(200, http.Header{"Cache-Control": {"max-age=60"}, "X-Version": {v}}, "body v"+v), nil
+	}
+
+	key := "http://example.org/replaced"
+	roundTripHTTPCacheTest(t, c, key, nil, next)
+	old := c.get(key)
+
+	// a refresh finishing between lookup and serve must not pair the old headers with the new body
+	if status, _, body := roundTripHTTPCacheTest(t, c, key, http.Header{"Cache-Control": {"no-cache"}}, next); status != "EXPIRED" || body != "body v2" {
+		t.Fatalf("HTTPCache.RoundTrip(no-cache) must return EXPIRED \"body v2\", not %s %#v", status, body)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, key, nil)
+	if resp, err := c.serve(req, old, time.Now()); err == nil {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Header.Get("x-version") != "1" || string(body) != "body v1" {
+			t.Errorf("HTTPCache.serve(old) must return x-version 1 with \"body v1\", not %s with %#v", resp.Header.Get("x-version"), body)
+		}
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.body")); len(matches) != 1 {
+		t.Errorf("HTTPCache must remove the replaced body file, not keep %d files", len(matches))
+	}
+	if size := c.diskSize.Load(); size != int64(len("body v2")) {
+		t.Errorf("HTTPCache disk size must be %d, not %d", len("body v2"), size)
+	}
+}
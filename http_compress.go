@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// HTTPCompressor negotiates the response content-encoding of web locations. gzip, br and zstd are
+// encoded on the fly, precompressed siblings are served as is.
+type HTTPCompressor struct {
+	Encodings     []string
+	Types         []string
+	MinLength     int
+	Level         int
+	Precompressed bool
+
+	writers map[string]*sync.Pool
+}
+
+// compressWriter is implemented by gzip.Writer, brotli.Writer and zstd.Encoder.
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var HTTPCompressExts = map[string]string{
+	"gzip": ".gz",
+	"br":   ".br",
+	"zstd": ".zst",
+}
+
+func (c *HTTPCompressor) Load() error {
+	if len(c.Encodings) == 0 {
+		// ties of accept-encoding go to the smaller encoding, brotli is the densest for text
+		c.Encodings = []string{"br", "zstd", "gzip"}
+	}
+	for _, encoding := range c.Encodings {
+		if _, ok := HTTPCompressExts[encoding]; !ok {
+			return fmt.Errorf("compress: unsupported encoding %#v", encoding)
+		}
+	}
+
+	if len(c.Types) == 0 {
+		c.Types = []string{
+			"text/*",
+			"application/javascript",
+			"application/json",
+			"application/manifest+json",
+			"application/wasm",
+			"application/xml",
+			"application/x-ns-proxy-autoconfig",
+			"image/svg+xml",
+		}
+	}
+
+	c.MinLength = cmp.Or(c.MinLength, 1024)
+
+	// level follows gzip, 1 (fastest) to 9 (best), and is mapped to brotli quality and zstd speed
+	if c.Level == 0 {
+		c.Level = gzip.DefaultCompression
+	}
+	if _, err := gzip.NewWriterLevel(io.Discard, c.Level); err != nil {
+		return fmt.Errorf("compress: %w", err)
+	}
+
+	c.writers = make(map[string]*sync.Pool)
+	for _, encoding := range c.Encodings {
+		var pool sync.Pool
+		switch encoding {
+		case "gzip":
+			pool.New = func() any {
+				w, _ := gzip.NewWriterLevel(io.Discard, c.Level)
+				return w
+			}
+		case "br":
+			quality := brotli.DefaultCompression
+			if c.Level > 0 {
+				quality = c.Level
+			}
+			pool.New = func() any {
+				return brotli.NewWriterLevel(io.Discard, quality)
+			}
+		case "zstd":
+			level := zstd.SpeedDefault
+			if c.Level > 0 {
+				level = zstd.EncoderLevelFromZstd(c.Level)
+			}
+			// browsers only decode windows up to 8MB, see RFC 9659
+			pool.New = func() any {
+				w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(level), zstd.WithWindowSize(8<<20), zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+				return w
+			}
+		}
+		c.writers[encoding] = &pool
+	}
+
+	return nil
+}
+
+// NegotiateContentEncoding picks the encoding of offers preferred by the accept-encoding header, ties are
+// broken by the order of offers. It returns "" if identity should be used.
+func NegotiateContentEncoding(acceptEncoding string, offers []string) string {
+	var best string
+	var bestq float64
+	for _, offer := range offers {
+		q, wildcard := -1.0, -1.0
+		for _, part := range strings.Split(acceptEncoding, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != offer && name != "*" {
+				continue
+			}
+			v := 1.0
+			for _, param := range strings.Split(params, ";") {
+				if k, s, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(k, "q") {
+					if f, err := strconv.ParseFloat(s, 64); err == nil {
+						v = f
+					}
+				}
+			}
+			if name == "*" {
+				wildcard = v
+			} else {
+				q = v
+			}
+		}
+		if q < 0 {
+			q = wildcard
+		}
+		if q > bestq {
+			best, bestq = offer, q
+		}
+	}
+	return best
+}
+
+// Compressible reports whether the content-type is in the mime type allowlist.
+func (c *HTTPCompressor) Compressible(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	// server-sent events must reach clients as written, an encoder would hold them back
+	if mediatype == "text/event-stream" {
+		return false
+	}
+	for _, s := range c.Types {
+		if prefix, ok := strings.CutSuffix(s, "/*"); ok {
+			if strings.HasPrefix(mediatype, prefix+"/") {
+				return true
+			}
+		} else if mediatype == s {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenPrecompressed opens the sibling of filename negotiated with the accept-encoding header, e.g. app.js.br.
+// It returns a nil file if no acceptable sibling exists.
+func (c *HTTPCompressor) OpenPrecompressed(filename, acceptEncoding string) (file *os.File, fi os.FileInfo, encoding string) {
+	if !c.Precompressed {
+		return
+	}
+
+	var offers []string
+	for _, encoding := range c.Encodings {
+		if fi, err := os.Stat(filename + HTTPCompressExts[encoding]); err == nil && fi.Mode().IsRegular() {
+			offers = append(offers, encoding)
+		}
+	}
+	if len(offers) == 0 {
+		return
+	}
+
+	encoding = NegotiateContentEncoding(acceptEncoding, offers)
+	if encoding == "" {
+		return
+	}
+
+	file, err := os.Open(filename + HTTPCompressExts[encoding])
+	if err != nil {
+		return nil, nil, ""
+	}
+	if fi, err = file.Stat(); err != nil {
+		file.Close()
+		return nil, nil, ""
+	}
+
+	return file, fi, encoding
+}
+
+// HTTPCompressHandler compresses the responses of a web location.
+type HTTPCompressHandler struct {
+	HTTPHandler
+	Compressor *HTTPCompressor
+}
+
+func (h *HTTPCompressHandler) Load() error {
+	if err := h.Compressor.Load(); err != nil {
+		return err
+	}
+	return h.HTTPHandler.Load()
+}
+
+func (h *HTTPCompressHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	encoding := NegotiateContentEncoding(req.Header.Get("accept-encoding"), h.Compressor.Encodings)
+
+	cw := &compressResponseWriter{ResponseWriter: rw, c: h.Compressor, encoding: encoding}
+	defer cw.Close()
+
+	h.HTTPHandler.ServeHTTP(cw, req)
+}
+
+// compressResponseWriter holds back up to MinLength bytes of a response with unknown length before
+// deciding whether to compress it.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	c        *HTTPCompressor
+	encoding string
+
+	status  int
+	decided bool
+	buf     []byte
+	cw      compressWriter
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	if code < 200 && code != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	w.status = code
+
+	header := w.Header()
+	switch {
+	case code == http.StatusSwitchingProtocols, code == http.StatusNoContent, code == http.StatusPartialContent, code == http.StatusNotModified:
+		w.decide(false)
+	case header.Get("content-encoding") != "", strings.Contains(header.Get("cache-control"), "no-transform"):
+		w.decide(false)
+	case header.Get("content-type") != "" && !w.c.Compressible(header.Get("content-type")):
+		w.decide(false)
+	case w.encoding == "":
+		if header.Get("content-type") != "" {
+			header.Add("vary", "accept-encoding")
+		}
+		w.decide(false)
+	case header.Get("content-length") != "" && header.Get("content-type") != "":
+		n, _ := strconv.ParseInt(header.Get("content-length"), 10, 64)
+		w.decide(n >= int64(w.c.MinLength))
+	}
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) >= w.c.MinLength {
+			w.decide(true)
+		}
+		return len(p), nil
+	}
+
+	if w.cw != nil {
+		return w.cw.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// decide writes the status line, the buffered bytes are flushed with the chosen encoding.
+func (w *compressResponseWriter) decide(compress bool) {
+	w.decided = true
+
+	header := w.Header()
+	if compress && header.Get("content-type") == "" {
+		header.Set("content-type", http.DetectContentType(w.buf))
+		compress = w.c.Compressible(header.Get("content-type"))
+	}
+
+	if compress {
+		header.Add("vary", "accept-encoding")
+		header.Set("content-encoding", w.encoding)
+		header.Del("content-length")
+		header.Del("accept-ranges")
+		if etag := header.Get("etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("etag", "W/"+etag)
+		}
+		w.cw = w.c.writers[w.encoding].Get().(compressWriter)
+		w.cw.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	if len(w.buf) > 0 {
+		buf := w.buf
+		w.buf = nil
+		w.Write(buf)
+	}
+}
+
+func (w *compressResponseWriter) Flush() {
+	if w.status != 0 && !w.decided {
+		// streaming responses are sent as is, the length can not be known in advance
+		w.decide(false)
+	}
+	if w.cw != nil {
+		w.cw.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%#v is not http.Hijacker", w.ResponseWriter)
+	}
+	w.decided = true
+	return hijacker.Hijack()
+}
+
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressResponseWriter) Close() error {
+	if w.status != 0 && !w.decided {
+		if w.Header().Get("content-length") == "" {
+			w.Header().Set("content-length", strconv.Itoa(len(w.buf)))
+		}
+		w.decide(false)
+	}
+	if w.cw != nil {
+		err := w.cw.Close()
+		w.cw.Reset(io.Discard)
+		w.c.writers[w.encoding].Put(w.cw)
+		w.cw = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestHTTPCompressorLoad(t *testing.T) {
+	cases := []struct {
+		Encodings     []string
+		Precompressed bool
+		Want          []string
+		Error         bool
+	}{
+		{nil, false, []string{"br", "zstd", "gzip"}, false},
+		{nil, true, []string{"br", "zstd", "gzip"}, false},
+		{[]string{"gzip"}, false, []string{"gzip"}, false},
+		{[]string{"br"}, false, []string{"br"}, false},
+		{[]string{"zstd", "gzip"}, false, []string{"zstd", "gzip"}, false},
+		{[]string{"zstd", "gzip"}, true, []string{"zstd", "gzip"}, false},
+		{[]string{"deflate"}, true, nil, true},
+	}
+
+	for _, c := range cases {
+		compressor := &HTTPCompressor{Encodings: c.Encodings, Precompressed: c.Precompressed}
+		err := compressor.Load()
+		switch {
+		case c.Error && err == nil:
+			t.Errorf("HTTPCompressor(%v, precompressed=%v).Load() must return error", c.Encodings, c.Precompressed)
+		case !c.Error && err != nil:
+			t.Errorf("HTTPCompressor(%v, precompressed=%v).Load() error: %+v", c.Encodings, c.Precompressed, err)
+		case !c.Error && !slices.Equal(compressor.Encodings, c.Want):
+			t.Errorf("HTTPCompressor(%v, precompressed=%v).Load() must set encodings %v, not %v", c.Encodings, c.Precompressed, c.Want, compressor.Encodings)
+		}
+	}
+
+	if err := (&HTTPCompressor{Level: 10}).Load(); err == nil {
+		t.Errorf("HTTPCompressor(level=10).Load() must return error")
+	}
+}
+
+func TestNegotiateContentEncoding(t *testing.T) {
+	cases := []struct {
+		AcceptEncoding string
+		Offers         []string
+		Encoding       string
+	}{
+		{"gzip, deflate, br, zstd", []string{"br", "zstd", "gzip"}, "br"},
+		{"gzip, deflate, br, zstd", []string{"zstd", "gzip"}, "zstd"},
+		{"gzip;q=1.0, br;q=0.5", []string{"br", "gzip"}, "gzip"},
+		{"GZIP", []string{"gzip"}, "gzip"},
+		{"*", []string{"br", "gzip"}, "br"},
+		{"*;q=0.1, gzip;q=0", []string{"br", "gzip"}, "br"},
+		{"gzip;q=0", []string{"gzip"}, ""},
+		{"identity", []string{"gzip"}, ""},
+		{"", []string{"gzip"}, ""},
+		{"gzip", nil, ""},
+	}
+
+	for _, c := range cases {
+		if encoding := NegotiateContentEncoding(c.AcceptEncoding, c.Offers); encoding != c.Encoding {
+			t.Errorf("NegotiateContentEncoding(%#v, %v) must return %#v, not %#v", c.AcceptEncoding, c.Offers, c.Encoding, encoding)
+		}
+	}
+}
+
+func TestHTTPCompressorCompressible(t *testing.T) {
+	c := &HTTPCompressor{}
+	if err := c.Load(); err != nil {
+		t.Fatalf("HTTPCompressor.Load error: %+v", err)
+	}
+
+	cases := []struct {
+		ContentType  string
+		Compressible bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"text/css", true},
+		{"application/json", true},
+		{"image/svg+xml", true},
+		{"application/javascript; charset=utf-8", true},
+		{"image/png", false},
+		{"application/octet-stream", false},
+		{"application/json-seq", false},
+		{"text/event-stream", false},
+		{"text/event-stream; charset=utf-8", false},
+		{"", false},
+		{"text", false},
+	}
+
+	for _, x := range cases {
+		if compressible := c.Compressible(x.ContentType); compressible != x.Compressible {
+			t.Errorf("HTTPCompressor.Compressible(%#v) must return %v, not %v", x.ContentType, x.Compressible, compressible)
+		}
+	}
+}
+
+func TestHTTPCompressorOpenPrecompressed(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.js")
+	for _, name := range []string{"app.js", "app.js.br", "app.js.gz"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("os.WriteFile error: %+v", err)
+		}
+	}
+
+	c := &HTTPCompressor{Precompressed: true}
+	if err := c.Load(); err != nil {
+		t.Fatalf("HTTPCompressor.Load error: %+v", err)
+	}
+
+	cases := []struct {
+		AcceptEncoding string
+		Encoding       string
+	}{
+		{"gzip, deflate, br, zstd", "br"},
+		{"zstd, gzip", "gzip"},
+		{"zstd", ""},
+		{"", ""},
+	}
+
+	for _, x := range cases {
+		file, _, encoding := c.OpenPrecompressed(filename, x.AcceptEncoding)
+		if encoding != x.Encoding {
+			t.Errorf("HTTPCompressor.OpenPrecompressed(%#v) must return %#v, not %#v", x.AcceptEncoding, x.Encoding, encoding)
+		}
+		if file != nil {
+			data, _ := io.ReadAll(file)
+			file.Close()
+			if want := "app.js" + HTTPCompressExts[x.Encoding]; string(data) != want {
+				t.Errorf("HTTPCompressor.OpenPrecompressed(%#v) must open %#v, not %#v", x.AcceptEncoding, want, data)
+			}
+		}
+	}
+
+	if file, _, _ := (&HTTPCompressor{}).OpenPrecompressed(filename, "br"); file != nil {
+		file.Close()
+		t.Errorf("HTTPCompressor.OpenPrecompressed must return nil without precompressed")
+	}
+}
+
+func TestHTTPCompressResponseWriter(t *testing.T) {
+	c := &HTTPCompressor{}
+	if err := c.Load(); err != nil {
+		t.Fatalf("HTTPCompressor.Load error: %+v", err)
+	}
+
+	cases := []struct {
+		ContentType string
+		Body        string
+		Offer       string
+		Encoding    string
+	}{
+		{"text/html", strings.Repeat("<p>hello</p>", 200), "gzip", "gzip"},
+		{"text/html", strings.Repeat("<p>hello</p>", 200), "br", "br"},
+		{"text/html", strings.Repeat("<p>hello</p>", 200), "zstd", "zstd"},
+		{"", strings.Repeat("<html><p>hello</p>", 200), "gzip", "gzip"},
+		{"text/html", "<p>hello</p>", "br", ""},
+		{"image/png", strings.Repeat("\x89PNG", 1000), "zstd", ""},
+		{"text/event-stream", strings.Repeat("data: hello\n\n", 200), "gzip", ""},
+	}
+
+	for _, x := range cases {
+		rec := httptest.NewRecorder()
+		w := &compressResponseWriter{ResponseWriter: rec, c: c, encoding: x.Offer}
+		if x.ContentType != "" {
+			w.Header().Set("content-type", x.ContentType)
+		}
+		io.WriteString(w, x.Body)
+		w.Close()
+
+		if encoding := rec.Header().Get("content-encoding"); encoding != x.Encoding {
+			t.Errorf("compressResponseWriter(%#v, %d bytes) must set content-encoding %#v, not %#v", x.ContentType, len(x.Body), x.Encoding, encoding)
+			continue
+		}
+
+		var r io.Reader = rec.Body
+		switch x.Encoding {
+		case "gzip":
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("gzip.NewReader error: %+v", err)
+			}
+			r = gz
+		case "br":
+			r = brotli.NewReader(rec.Body)
+		case "zstd":
+			zr, err := zstd.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("zstd.NewReader error: %+v", err)
+			}
+			defer zr.Close()
+			r = zr
+		}
+		if data, _ := io.ReadAll(r); string(data) != x.Body {
+			t.Errorf("compressResponseWriter(%#v) must round trip %d bytes, not %d", x.ContentType, len(x.Body), len(data))
+		}
+		if rec.Code != http.StatusOK {
+			t.Errorf("compressResponseWriter(%#v) must return 200, not %d", x.ContentType, rec.Code)
+		}
+	}
+}
@@ -113,7 +113,8 @@ func main() {
 
 	// resolver factory
 	resolvers := map[string]*Resolver{}
-	resolverof := func(addr string) *Resolver {
+	var resolverof func(addr string) *Resolver
+	resolverof = func(addr string) *Resolver {
 		r, _ := resolvers[addr]
 		if r != nil {
 			return r
@@ -122,8 +123,10 @@ func main() {
 			Client: &fastdns.Client{
 				Addr: addr,
 			},
-			CacheDuration: 10 * time.Minute,
-			LRUCache:      lru.NewTTLCache[string, []netip.Addr](max(config.Global.DnsCacheSize, 64*1024)),
+			CacheDuration:         10 * time.Minute,
+			CacheMinDuration:      time.Minute,
+			NegativeCacheDuration: 30 * time.Second,
+			LRUCache:              lru.NewTTLCache[string, []netip.Addr](max(config.Global.DnsCacheSize, 64*1024)),
 		}
 		if config.Global.DnsCacheDuration != "" {
 			dur, err := time.ParseDuration(config.Global.DnsCacheDuration)
@@ -132,9 +135,40 @@ func main() {
 			}
 			r.CacheDuration = dur
 		}
+		for _, x := range []struct {
+			Name  string
+			Value string
+			Dur   *time.Duration
+		}{
+			{"dns_cache_min_ttl", config.Global.DnsCacheMinTTL, &r.CacheMinDuration},
+			{"dns_negative_ttl", config.Global.DnsNegativeTTL, &r.NegativeCacheDuration},
+			{"dns_serve_stale", config.Global.DnsServeStale, &r.StaleCacheDuration},
+		} {
+			if x.Value == "" {
+				continue
+			}
+			dur, err := time.ParseDuration(x.Value)
+			if err != nil {
+				log.Fatal().Err(err).Str(x.Name, x.Value).Msg("invalid " + x.Name)
+			}
+			*x.Dur = dur
+		}
 		switch {
 		case addr == "":
 			log.Fatal().Str("addr", addr).Msg("invalid dns_server addr")
+		case strings.ContainsAny(addr, ", "):
+			r.Strategy = cmp.Or(config.Global.DnsStrategy, "fallback")
+			r.UpstreamTimeout = 5 * time.Second
+			switch r.Strategy {
+			case "race", "fallback", "round_robin":
+			default:
+				log.Fatal().Str("dns_strategy", r.Strategy).Strs("support strategies", []string{"race", "fallback", "round_robin"}).Msg("invalid dns_strategy")
+			}
+			for _, s := range strings.FieldsFunc(addr, func(c rune) bool { return c == ',' || c == ' ' }) {
+				r.Upstreams = append(r.Upstreams, &ResolverUpstream{Client: resolverof(s).Client})
+			}
+			// the promoted lookups of fastdns.Client, e.g. LookupHTTPS of tunnel ech, go through the upstreams
+			r.Client.Dialer = &ResolverExchangeDialer{Resolver: r}
 		case strings.Contains(addr, "://"):
 			u, err := url.Parse(addr)
 			if err != nil {
@@ -267,10 +301,27 @@ func main() {
 		break
 	}
 
+	for _, dnsConfig := range config.Dns {
+		if dnsConfig.FakeIP == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(dnsConfig.FakeIP)
+		if err != nil {
+			log.Fatal().Err(err).Str("dns_fake_ip", dnsConfig.FakeIP).Msg("parse dns fake_ip error")
+		}
+		switch {
+		case geoResolver.FakeIP == nil:
+			geoResolver.FakeIP = &FakeIPPool{Prefix: prefix}
+		case geoResolver.FakeIP.Prefix != prefix:
+			log.Fatal().Str("dns_fake_ip", dnsConfig.FakeIP).Stringer("dns_fake_ip_prefix", geoResolver.FakeIP.Prefix).Msg("dns fake_ip conflicts with another dns listener")
+		}
+	}
+
 	// global dialer
 	dialer := &LocalDialer{
 		Resolver:        geoResolver.Resolver,
 		ResolveCache:    lru.NewTTLCache[string, []netip.Addr](8192),
+		FakeIP:          geoResolver.FakeIP,
 		Concurrency:     2,
 		PerferIPv6:      false,
 		ForbidLocalAddr: config.Global.ForbidLocalAddr,
@@ -295,6 +346,7 @@ func main() {
 			dialers[name] = &LocalDialer{
 				Resolver:        geoResolver.Resolver,
 				ResolveCache:    dialer.ResolveCache,
+				FakeIP:          geoResolver.FakeIP,
 				Interface:       u.Host,
 				PerferIPv6:      u.Query().Get("prefer_ipv6") == "true",
 				Concurrency:     2,
@@ -320,6 +372,7 @@ func main() {
 				ClientKey:  u.Query().Get("key"),
 				ClientCert: u.Query().Get("cert"),
 				Resolve:    map[string]string{u.Host: u.Query().Get("resolve")},
+				Via:        u.Query().Get("via"),
 				Dialer:     dialer,
 			}
 		case "http2":
@@ -334,6 +387,7 @@ func main() {
 				ClientKey:  u.Query().Get("key"),
 				ClientCert: u.Query().Get("cert"),
 				MaxClients: cmp.Or(first(strconv.Atoi(u.Query().Get("max_clients"))), 8),
+				Via:        u.Query().Get("via"),
 				Dialer:     dialer,
 			}
 		case "http3", "http3+wss":
@@ -355,6 +409,7 @@ func main() {
 				Port:     u.Port(),
 				Socks5H:  u.Scheme == "socks5h",
 				Resolver: geoResolver.Resolver,
+				Via:      u.Query().Get("via"),
 				Dialer:   dialer,
 			}
 		case "socks4", "socks4a":
@@ -365,6 +420,7 @@ func main() {
 				Port:     u.Port(),
 				Socks4A:  u.Scheme == "socks4a",
 				Resolver: geoResolver.Resolver,
+				Via:      u.Query().Get("via"),
 				Dialer:   dialer,
 			}
 		case "ssh", "ssh2":
@@ -378,11 +434,62 @@ func main() {
 				UserKnownHostsFile:    cmp.Or(u.Query().Get("UserKnownHostsFile"), u.Query().Get("user_known_hosts_file")),
 				MaxClients:            cmp.Or(first(strconv.Atoi(u.Query().Get("max_clients"))), 8),
 				Timeout:               time.Duration(cmp.Or(first(strconv.Atoi(u.Query().Get("timeout"))), 10)) * time.Second,
+				Via:                   u.Query().Get("via"),
 				Dialer:                dialer,
 			}
+		case "group":
+			dialers[name] = &GroupDialer{
+				Name:          name,
+				Members:       strings.FieldsFunc(u.Query().Get("members"), func(c rune) bool { return c == ',' }),
+				Strategy:      u.Query().Get("strategy"),
+				CheckAddr:     cmp.Or(u.Query().Get("check"), "www.gstatic.com:443"),
+				CheckInterval: time.Duration(cmp.Or(first(strconv.Atoi(u.Query().Get("check_interval"))), 30)) * time.Second,
+				CheckTimeout:  time.Duration(cmp.Or(first(strconv.Atoi(u.Query().Get("check_timeout"))), 5)) * time.Second,
+				Dialers:       dialers,
+			}
 		default:
 			log.Fatal().Str("dialer_scheme", u.Scheme).Msgf("unsupported dialer=%+v", u)
 		}
+		if via := u.Query().Get("via"); via != "" && DialerVia(dialers[name]) != via {
+			log.Fatal().Str("dialer_name", name).Str("dialer_scheme", u.Scheme).Str("dialer_via", via).Msg("dialer does not support via")
+		}
+	}
+	// via chains and group members share one graph, e.g. x?via=g with g: group://?members=x is a cycle
+	for name := range dialers {
+		if cycle := DialerCycle(dialers, name); cycle != nil {
+			log.Fatal().Str("dialer_name", name).Str("dialer_chain", strings.Join(cycle, ">")).Msg("dialer via cycle detected")
+		}
+	}
+	for name, d := range dialers {
+		via := DialerVia(d)
+		if via == "" {
+			continue
+		}
+		next, ok := dialers[via]
+		if !ok {
+			log.Fatal().Str("dialer_name", name).Str("dialer_via", via).Msg("via dialer not exists")
+		}
+		switch d := d.(type) {
+		case *HTTPDialer:
+			d.Dialer = next
+		case *HTTP2Dialer:
+			d.Dialer = next
+		case *Socks5Dialer:
+			d.Dialer = next
+		case *Socks4Dialer:
+			d.Dialer = next
+		case *SSHDialer:
+			d.Dialer = next
+		}
+		log.Info().Str("dialer_name", name).Str("dialer_chain", DialerChain(dialers, name)).Msg("dialer chain ok")
+	}
+	for name, d := range dialers {
+		if d, ok := d.(*GroupDialer); ok {
+			if err := d.Load(); err != nil {
+				log.Fatal().Err(err).Str("dialer_name", name).Msgf("%T.Load() return error: %+v", d, err)
+			}
+			log.Info().Str("dialer_name", name).Strs("dialer_members", d.Members).Str("dialer_strategy", d.Strategy).Msgf("%T.Load() ok", d)
+		}
 	}
 
 	// see http.DefaultTransport
@@ -424,6 +531,29 @@ func main() {
 	}
 	log.Info().Msgf("%T.Load() ok", functions.GeoSite)
 
+	// global resolver hosts and rules
+	if config.Global.DnsHosts != "" {
+		geoResolver.Resolver.Hosts = &FileLoader[map[string][]netip.Addr]{
+			Filename:     config.Global.DnsHosts,
+			Unmarshal:    HostsUnmarshal,
+			PollDuration: 15 * time.Second,
+			Logger:       log.DefaultLogger.Slog(),
+		}
+		hosts := geoResolver.Resolver.Hosts.Load()
+		if hosts == nil {
+			log.Fatal().Str("dns_hosts", config.Global.DnsHosts).Msg("load dns_hosts failed")
+		}
+		log.Info().Str("dns_hosts", config.Global.DnsHosts).Int("dns_hosts_size", len(*hosts)).Msg("load dns_hosts ok")
+	}
+	for _, rule := range config.Global.DnsRules {
+		geoResolver.Resolver.Rules = append(geoResolver.Resolver.Rules, ResolverRule{
+			Domains:  rule.Domains,
+			Geosite:  rule.Geosite,
+			Resolver: resolverof(rule.DnsServer),
+		})
+	}
+	geoResolver.Resolver.GeoSite = functions.geosite
+
 	lc := ListenConfig{
 		FastOpen:    false,
 		ReusePort:   true,
@@ -440,8 +570,22 @@ func main() {
 	// listen and serve https
 	tlsConfigurator := &TLSInspector{
 		ClientHelloMap: xsync.NewMapOf[string, *tls.ClientHelloInfo](),
+		RootCA:         DefaultRootCA(),
+	}
+	// proxy protocol of listeners
+	proxyprotocolof := func(enabled bool, trusted []string) *ProxyProtocolConfig {
+		if !enabled {
+			return nil
+		}
+		p, err := NewProxyProtocolConfig(trusted)
+		if err != nil {
+			log.Fatal().Err(err).Strs("proxy_protocol_trusted", trusted).Msg("invalid proxy_protocol_trusted")
+		}
+		return p
 	}
+
 	h2handlers := map[string]map[string]HTTPHandler{}
+	h2proxyprotocols := map[string]*ProxyProtocolConfig{}
 	for _, server := range config.Https {
 		handler := &HTTPServerHandler{
 			ForwardHandler: &HTTPForwardHandler{
@@ -451,13 +595,16 @@ func main() {
 				LocalTransport: transport,
 				Dialers:        dialers,
 				Functions:      functions.FuncMap,
+				RootCA:         tlsConfigurator.RootCA,
 			},
 			TunnelHandler: &HTTPTunnelHandler{
 				Config: server,
 			},
 			WebHandler: &HTTPWebHandler{
 				Config:    server,
+				Logger:    forwardLogger,
 				Transport: transport,
+				Resolver:  geoResolver.Resolver,
 				Functions: functions.FuncMap,
 			},
 			ServerNames:    server.ServerName,
@@ -486,12 +633,19 @@ func main() {
 		}
 
 		for _, listen := range server.Listen {
+			if p := proxyprotocolof(server.ProxyProtocol, server.ProxyProtocolTrusted); p != nil {
+				h2proxyprotocols[listen] = p
+			}
 			for _, sniproxy := range server.Sniproxy {
-				tlsConfigurator.AddSniproxy(TLSInspectorSniproxy{
-					ServerName: sniproxy.ServerName,
-					ProxyPass:  sniproxy.ProxyPass,
-					Dialer:     dialer,
+				err := tlsConfigurator.AddSniproxy(TLSInspectorSniproxy{
+					ServerName:        sniproxy.ServerName,
+					ProxyPass:         sniproxy.ProxyPass,
+					SendProxyProtocol: sniproxy.SendProxyProtocol,
+					Dialer:            dialer,
 				})
+				if err != nil {
+					log.Fatal().Err(err).Str("sniproxy_server_name", sniproxy.ServerName).Msg("add sniproxy error")
+				}
 			}
 			for _, name := range server.ServerName {
 				config, _ := server.ServerConfig[name]
@@ -578,8 +732,9 @@ func main() {
 			KeepAlivePeriod: 3 * time.Minute,
 			// ReadBufferSize:  1 << 20,
 			// WriteBufferSize: 1 << 20,
-			MirrorHeader: true,
-			TLSConfig:    server.TLSConfig,
+			MirrorHeader:  true,
+			TLSConfig:     server.TLSConfig,
+			ProxyProtocol: h2proxyprotocols[addr],
 		})
 
 		servers = append(servers, server)
@@ -604,7 +759,7 @@ func main() {
 	}
 
 	// listen and serve http
-	h1handlers := map[string]HTTPHandler{}
+	h1handlers := map[string]*HTTPServerHandler{}
 	for _, httpConfig := range config.Http {
 		httpConfig.ServerName = append(httpConfig.ServerName, "", "localhost", "127.0.0.1")
 		if name, err := os.Hostname(); err == nil {
@@ -621,13 +776,16 @@ func main() {
 				LocalTransport: transport,
 				Dialers:        dialers,
 				Functions:      functions.FuncMap,
+				RootCA:         tlsConfigurator.RootCA,
 			},
 			TunnelHandler: &HTTPTunnelHandler{
 				Config: httpConfig,
 			},
 			WebHandler: &HTTPWebHandler{
 				Config:    httpConfig,
+				Logger:    forwardLogger,
 				Transport: transport,
+				Resolver:  geoResolver.Resolver,
 				Functions: functions.FuncMap,
 			},
 			ServerNames:    httpConfig.ServerName,
@@ -676,6 +834,7 @@ func main() {
 			KeepAlivePeriod: 3 * time.Minute,
 			ReadBufferSize:  32 * 1024,
 			WriteBufferSize: 32 * 1024,
+			ProxyProtocol:   proxyprotocolof(handler.Config.ProxyProtocol, handler.Config.ProxyProtocolTrusted),
 		}
 		if _, ok := memoryListeners.Load(addr); ok {
 			newln := &MemoryListener{Listener: ln}
@@ -693,11 +852,35 @@ func main() {
 		for _, addr := range socksConfig.Listen {
 			var ln net.Listener
 
-			if ln, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
+			// redir://:12345 and tproxy://:12345 accept connections redirected by iptables
+			var transparent string
+			if u, err := url.Parse(addr); err == nil && u.Scheme != "" && u.Host != "" {
+				transparent, addr = u.Scheme, u.Host
+			}
+
+			switch transparent {
+			case "", "redir":
+				ln, err = lc.Listen(context.Background(), "tcp", addr)
+			case "tproxy":
+				tlc := lc
+				tlc.Transparent = true
+				ln, err = tlc.Listen(context.Background(), "tcp", addr)
+			default:
+				log.Fatal().Str("address", addr).Str("transparent", transparent).Msg("unsupported socks listen scheme")
+			}
+			if err != nil {
 				log.Fatal().Err(err).Str("address", addr).Msg("net.Listen error")
 			}
 
-			log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and serve socks")
+			log.Info().Str("version", version).Str("address", ln.Addr().String()).Str("transparent", transparent).Msg("liner listen and serve socks")
+
+			// transparent connections are dispatched by their original destination, which needs the raw tcp connection
+			if transparent == "" {
+				ln = TCPListener{
+					TCPListener:   ln.(*net.TCPListener),
+					ProxyProtocol: proxyprotocolof(socksConfig.ProxyProtocol, socksConfig.ProxyProtocolTrusted),
+				}
+			}
 
 			h := &SocksHandler{
 				Config:        socksConfig,
@@ -712,7 +895,7 @@ func main() {
 				log.Fatal().Err(err).Str("address", addr).Msg("socks hanlder load error")
 			}
 
-			go func(ln net.Listener, h *SocksHandler) {
+			go func(ln net.Listener, h *SocksHandler, transparent string) {
 				for {
 					conn, err := ln.Accept()
 					if err != nil {
@@ -720,9 +903,14 @@ func main() {
 						time.Sleep(10 * time.Millisecond)
 						continue
 					}
-					go h.ServeConn(context.Background(), conn)
+					switch transparent {
+					case "redir", "tproxy":
+						go h.ServeRedirConn(context.Background(), conn, transparent == "tproxy")
+					default:
+						go h.ServeConn(context.Background(), conn)
+					}
 				}
-			}(ln, h)
+			}(ln, h, transparent)
 		}
 	}
 
@@ -731,24 +919,43 @@ func main() {
 		for _, addr := range streamConfig.Listen {
 			var ln net.Listener
 
-			if ln, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
-				log.Fatal().Err(err).Str("address", addr).Msg("net.Listen error")
-			}
-
-			log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and forward port")
-
 			h := &StreamHandler{
 				Config:        streamConfig,
 				ForwardLogger: forwardLogger,
 				GeoResolver:   geoResolver,
 				LocalDialer:   dialer,
 				Dialers:       dialers,
+				Functions:     functions.FuncMap,
 			}
 
 			if err = h.Load(); err != nil {
 				log.Fatal().Err(err).Str("address", addr).Msg("stream hanlder load error")
 			}
 
+			// udp://:53 forwards datagrams
+			if u, err := url.Parse(addr); err == nil && strings.HasPrefix(u.Scheme, "udp") && u.Host != "" {
+				conn, err := lc.ListenPacket(context.Background(), u.Scheme, u.Host)
+				if err != nil {
+					log.Fatal().Err(err).Str("address", addr).Msg("net.ListenPacket error")
+				}
+
+				log.Info().Str("version", version).Str("address", conn.LocalAddr().String()).Msg("liner listen and forward udp port")
+
+				go h.ServePacketConn(context.Background(), conn)
+				continue
+			}
+
+			if ln, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
+				log.Fatal().Err(err).Str("address", addr).Msg("net.Listen error")
+			}
+
+			log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and forward port")
+
+			ln = TCPListener{
+				TCPListener:   ln.(*net.TCPListener),
+				ProxyProtocol: proxyprotocolof(streamConfig.ProxyProtocol, streamConfig.ProxyProtocolTrusted),
+			}
+
 			go func(ln net.Listener, h *StreamHandler) {
 				for {
 					conn, err := ln.Accept()
@@ -779,6 +986,131 @@ func main() {
 		go h.Serve(context.Background())
 	}
 
+	// dns handler
+	dnsGetCertificate := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			hello.ServerName = tlsConfigurator.DefaultServername
+		}
+		return tlsConfigurator.GetCertificate(hello)
+	}
+	for _, dnsConfig := range config.Dns {
+		h := &DnsHandler{
+			Config:    dnsConfig,
+			Logger:    forwardLogger,
+			Resolver:  geoResolver.Resolver,
+			Resolvers: make(map[string]*Resolver),
+			Functions: functions.FuncMap,
+		}
+		if dnsConfig.FakeIP != "" {
+			h.FakeIP = geoResolver.FakeIP
+		}
+		for name, addr := range dnsConfig.DnsServers {
+			h.Resolvers[name] = resolverof(addr)
+		}
+
+		if err = h.Load(); err != nil {
+			log.Fatal().Err(err).Strs("dns_listen", dnsConfig.Listen).Msg("dns hanlder load error")
+		}
+
+		for _, listen := range dnsConfig.Listen {
+			networks, addr := []string{"udp", "tcp"}, listen
+			if u, err := url.Parse(listen); err == nil && u.Scheme != "" && u.Host != "" {
+				networks, addr = []string{u.Scheme}, u.Host
+			}
+
+			for _, network := range networks {
+				switch network {
+				case "udp", "udp4", "udp6":
+					conn, err := lc.ListenPacket(context.Background(), network, addr)
+					if err != nil {
+						log.Fatal().Err(err).Str("address", addr).Msg("net.ListenPacket error")
+					}
+
+					log.Info().Str("version", version).Str("address", conn.LocalAddr().String()).Msg("liner listen and serve dns over udp")
+
+					go h.ServePacketConn(context.Background(), conn)
+				case "tcp", "tcp4", "tcp6":
+					ln, err := lc.Listen(context.Background(), network, addr)
+					if err != nil {
+						log.Fatal().Err(err).Str("address", addr).Msg("net.Listen error")
+					}
+
+					log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and serve dns over tcp")
+
+					go func(ln net.Listener, h *DnsHandler) {
+						for {
+							conn, err := ln.Accept()
+							if err != nil {
+								log.Error().Err(err).Str("version", version).Str("address", ln.Addr().String()).Msg("liner accept dns connection error")
+								time.Sleep(10 * time.Millisecond)
+								continue
+							}
+							go h.ServeConn(context.Background(), conn)
+						}
+					}(ln, h)
+				case "tls", "dot":
+					ln, err := lc.Listen(context.Background(), "tcp", addr)
+					if err != nil {
+						log.Fatal().Err(err).Str("address", addr).Msg("net.Listen error")
+					}
+
+					log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and serve dns over tls")
+
+					ln = tls.NewListener(ln, &tls.Config{
+						MinVersion:     tls.VersionTLS12,
+						NextProtos:     []string{"dot"},
+						GetCertificate: dnsGetCertificate,
+					})
+
+					go func(ln net.Listener, h *DnsHandler) {
+						for {
+							conn, err := ln.Accept()
+							if err != nil {
+								log.Error().Err(err).Str("version", version).Str("address", ln.Addr().String()).Msg("liner accept dns connection error")
+								time.Sleep(10 * time.Millisecond)
+								continue
+							}
+							go h.ServeConn(context.Background(), conn)
+						}
+					}(ln, h)
+				case "quic", "doq":
+					conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+					if err != nil {
+						log.Fatal().Err(err).Str("address", addr).Msg("net.ListenPacket error")
+					}
+
+					ln, err := quic.Listen(conn, &tls.Config{
+						MinVersion:     tls.VersionTLS13,
+						NextProtos:     []string{"doq"},
+						GetCertificate: dnsGetCertificate,
+					}, &quic.Config{
+						MaxIdleTimeout:     30 * time.Second,
+						MaxIncomingStreams: 100,
+					})
+					if err != nil {
+						log.Fatal().Err(err).Str("address", addr).Msg("quic.Listen error")
+					}
+
+					log.Info().Str("version", version).Str("address", ln.Addr().String()).Msg("liner listen and serve dns over quic")
+
+					go func(ln *quic.Listener, h *DnsHandler) {
+						for {
+							conn, err := ln.Accept(context.Background())
+							if err != nil {
+								log.Error().Err(err).Str("version", version).Str("address", ln.Addr().String()).Msg("liner accept dns quic connection error")
+								time.Sleep(10 * time.Millisecond)
+								continue
+							}
+							go h.ServeQuicConn(context.Background(), conn)
+						}
+					}(ln, h)
+				default:
+					log.Fatal().Str("dns_listen", listen).Msg("unsupported dns listen network")
+				}
+			}
+		}
+	}
+
 	var cronOptions = []cron.Option{
 		cron.WithSeconds(),
 		cron.WithLogger(cron.PrintfLogger(&log.DefaultLogger)),
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolConfig enables PROXY protocol headers from Trusted sources, all sources are trusted if it is empty.
+type ProxyProtocolConfig struct {
+	Trusted []netip.Prefix
+}
+
+func (p *ProxyProtocolConfig) Trust(addr net.Addr) bool {
+	if len(p.Trusted) == 0 {
+		return true
+	}
+	ip := AddrPortOf(addr).Addr().Unmap()
+	return slices.ContainsFunc(p.Trusted, func(prefix netip.Prefix) bool { return prefix.Contains(ip) })
+}
+
+// ProxyProtocolConn parses the PROXY protocol v1/v2 header sent by load balancers on the first
+// Read or RemoteAddr call, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+type ProxyProtocolConn struct {
+	net.Conn
+	Timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	source net.Addr
+	err    error
+}
+
+func (c *ProxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		c.reader = bufio.NewReaderSize(c.Conn, 256)
+		c.source, c.err = ReadProxyProtocolHeader(c.reader)
+	})
+}
+
+func (c *ProxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *ProxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *ProxyProtocolConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ReadProxyProtocolHeader reads a PROXY protocol v1 or v2 header, it returns a nil addr for
+// LOCAL and UNKNOWN connections which keep their own remote address.
+func ReadProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil && !(err == io.EOF && len(b) >= 6) {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(b, proxyProtocolV2Signature):
+		return readProxyProtocolV2(r)
+	case bytes.HasPrefix(b, []byte("PROXY ")):
+		return readProxyProtocolV1(r)
+	}
+
+	return nil, errors.New("proxy protocol: invalid header")
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	// PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n, at most 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy protocol: v1 header too long")
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	switch {
+	case len(parts) >= 2 && parts[1] == "UNKNOWN":
+		return nil, nil
+	case len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6"):
+		return nil, errors.New("proxy protocol: invalid v1 header " + strconv.Quote(string(line)))
+	}
+
+	ip, err := netip.ParseAddr(parts[2])
+	if err != nil {
+		return nil, errors.New("proxy protocol: invalid v1 source address " + strconv.Quote(parts[2]))
+	}
+	port, err := strconv.ParseUint(parts[4], 10, 16)
+	if err != nil {
+		return nil, errors.New("proxy protocol: invalid v1 source port " + strconv.Quote(parts[4]))
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	// signature(12) ver_cmd(1) fam(1) len(2) addresses(len)
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("proxy protocol: unsupported v2 version " + strconv.Itoa(int(header[12]>>4)))
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command, e.g. health checks of the load balancer
+	if header[12]&0x0f == 0x00 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, errors.New("proxy protocol: short v2 ipv4 addresses")
+		}
+		ip := netip.AddrFrom4([4]byte(data[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(data[8:10]))), nil
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, errors.New("proxy protocol: short v2 ipv6 addresses")
+		}
+		ip := netip.AddrFrom16([16]byte(data[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(data[32:34]))), nil
+	}
+
+	return nil, nil
+}
+
+// NewProxyProtocolConfig parses trusted CIDRs or addresses of load balancers.
+func NewProxyProtocolConfig(trusted []string) (*ProxyProtocolConfig, error) {
+	p := &ProxyProtocolConfig{}
+	for _, s := range trusted {
+		if prefix, err := netip.ParsePrefix(s); err == nil {
+			p.Trusted = append(p.Trusted, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, errors.New("proxy protocol: invalid trusted address " + strconv.Quote(s))
+		}
+		p.Trusted = append(p.Trusted, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return p, nil
+}
+
+// AppendProxyProtocolHeader appends a PROXY protocol "v1" or "v2" header of a tcp connection
+// from source to destination, invalid addresses are sent as UNKNOWN or LOCAL.
+func AppendProxyProtocolHeader(dst []byte, version string, source, destination netip.AddrPort) ([]byte, error) {
+	src, dest := source.Addr().Unmap(), destination.Addr().Unmap()
+	valid := source.IsValid() && destination.IsValid()
+	ipv4 := src.Is4() && dest.Is4()
+
+	switch version {
+	case "v1":
+		if !valid {
+			return append(dst, "PROXY UNKNOWN\r\n"...), nil
+		}
+		if ipv4 {
+			dst = append(dst, "PROXY TCP4 "...)
+		} else {
+			src, dest = netip.AddrFrom16(src.As16()), netip.AddrFrom16(dest.As16())
+			dst = append(dst, "PROXY TCP6 "...)
+		}
+		dst = append(src.AppendTo(dst), ' ')
+		dst = append(dest.AppendTo(dst), ' ')
+		dst = append(strconv.AppendUint(dst, uint64(source.Port()), 10), ' ')
+		dst = append(strconv.AppendUint(dst, uint64(destination.Port()), 10), '\r', '\n')
+		return dst, nil
+	case "v2":
+		dst = append(dst, proxyProtocolV2Signature...)
+		switch {
+		case !valid:
+			return append(dst, 0x20, 0x00, 0x00, 0x00), nil
+		case ipv4:
+			dst = append(dst, 0x21, 0x11, 0x00, 12)
+			dst = append(dst, src.AsSlice()...)
+			dst = append(dst, dest.AsSlice()...)
+		default:
+			a, b := src.As16(), dest.As16()
+			dst = append(dst, 0x21, 0x21, 0x00, 36)
+			dst = append(dst, a[:]...)
+			dst = append(dst, b[:]...)
+		}
+		dst = binary.BigEndian.AppendUint16(dst, source.Port())
+		dst = binary.BigEndian.AppendUint16(dst, destination.Port())
+		return dst, nil
+	}
+
+	return nil, errors.New("proxy protocol: unsupported version " + strconv.Quote(version))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	cases := []struct {
+		Version     string
+		Source      netip.AddrPort
+		Destination netip.AddrPort
+		Header      string
+		Addr        string
+	}{
+		{
+			"v1",
+			netip.MustParseAddrPort("1.2.3.4:1234"),
+			netip.MustParseAddrPort("5.6.7.8:443"),
+			"PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n",
+			"1.2.3.4:1234",
+		},
+		{
+			"v1",
+			netip.MustParseAddrPort("[::ffff:1.2.3.4]:1234"),
+			netip.MustParseAddrPort("5.6.7.8:443"),
+			"PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\r\n",
+			"1.2.3.4:1234",
+		},
+		{
+			"v1",
+			netip.MustParseAddrPort("[2001:db8::1]:1234"),
+			netip.MustParseAddrPort("[2001:db8::2]:443"),
+			"PROXY TCP6 2001:db8::1 2001:db8::2 1234 443\r\n",
+			"[2001:db8::1]:1234",
+		},
+		{
+			"v1",
+			netip.AddrPort{},
+			netip.MustParseAddrPort("5.6.7.8:443"),
+			"PROXY UNKNOWN\r\n",
+			"",
+		},
+		{
+			"v2",
+			netip.MustParseAddrPort("1.2.3.4:1234"),
+			netip.MustParseAddrPort("5.6.7.8:443"),
+			"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\x01\x02\x03\x04\x05\x06\x07\x08\x04\xd2\x01\xbb",
+			"1.2.3.4:1234",
+		},
+		{
+			"v2",
+			netip.MustParseAddrPort("[2001:db8::1]:1234"),
+			netip.MustParseAddrPort("[2001:db8::2]:443"),
+			"\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x04\xd2\x01\xbb",
+			"[2001:db8::1]:1234",
+		},
+		{
+			"v2",
+			netip.AddrPort{},
+			netip.AddrPort{},
+			"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00",
+			"",
+		},
+	}
+
+	for _, c := range cases {
+		header, err := AppendProxyProtocolHeader(nil, c.Version, c.Source, c.Destination)
+		if err != nil || string(header) != c.Header {
+			t.Errorf("AppendProxyProtocolHeader(%#v, %s, %s) must return %q, not %q err=%+v", c.Version, c.Source, c.Destination, c.Header, header, err)
+			continue
+		}
+
+		r := bufio.NewReader(strings.NewReader(c.Header + "payload"))
+		addr, err := ReadProxyProtocolHeader(r)
+		if err != nil {
+			t.Errorf("ReadProxyProtocolHeader(%q) error: %+v", c.Header, err)
+			continue
+		}
+		switch {
+		case c.Addr == "" && addr != nil:
+			t.Errorf("ReadProxyProtocolHeader(%q) must return nil addr, not %s", c.Header, addr)
+		case c.Addr != "" && (addr == nil || addr.String() != c.Addr):
+			t.Errorf("ReadProxyProtocolHeader(%q) must return %#v, not %v", c.Header, c.Addr, addr)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("ReadProxyProtocolHeader(%q) must leave \"payload\", not %q", c.Header, rest)
+		}
+	}
+
+	if _, err := AppendProxyProtocolHeader(nil, "v3", netip.AddrPort{}, netip.AddrPort{}); err == nil {
+		t.Errorf("AppendProxyProtocolHeader(\"v3\") must return error")
+	}
+}
+
+func TestProxyProtocolHeaderMalformed(t *testing.T) {
+	cases := []string{
+		"",
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1234",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1234 443\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1234 443 " + strings.Repeat("0", 100) + "\r\n",
+		"PROXY UDP4 1.2.3.4 5.6.7.8 1234 443\r\n",
+		"PROXY TCP4 1.2.3.x 5.6.7.8 1234 443\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 65536 443\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\x01\x02\x03\x04",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x01\x02\x03\x04",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x0c\x01\x02\x03\x04\x05\x06\x07\x08\x04\xd2\x01\xbb",
+		"\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x0c\x01\x02\x03\x04\x05\x06\x07\x08\x04\xd2\x01\xbb",
+	}
+
+	for _, c := range cases {
+		addr, err := ReadProxyProtocolHeader(bufio.NewReader(strings.NewReader(c)))
+		if err == nil {
+			t.Errorf("ReadProxyProtocolHeader(%q) must return error, not %v", c, addr)
+		}
+	}
+}
+
+func TestProxyProtocolConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		header, _ := AppendProxyProtocolHeader(nil, "v2", netip.MustParseAddrPort("1.2.3.4:1234"), netip.MustParseAddrPort("5.6.7.8:443"))
+		c2.Write(append(header, "payload"...))
+		c2.Close()
+	}()
+
+	conn := &ProxyProtocolConn{Conn: c1, Timeout: 5 * time.Second}
+	if addr := conn.RemoteAddr().String(); addr != "1.2.3.4:1234" {
+		t.Errorf("ProxyProtocolConn.RemoteAddr() must return \"1.2.3.4:1234\", not %#v", addr)
+	}
+	if data, err := io.ReadAll(conn); err != nil || string(data) != "payload" {
+		t.Errorf("ProxyProtocolConn.Read() must return \"payload\", not %q err=%+v", data, err)
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	if _, err := NewProxyProtocolConfig([]string{"10.0.0.0/8", "bad"}); err == nil {
+		t.Errorf("NewProxyProtocolConfig(\"bad\") must return error")
+	}
+
+	config, err := NewProxyProtocolConfig([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("NewProxyProtocolConfig error: %+v", err)
+	}
+
+	cases := []struct {
+		Addr  string
+		Trust bool
+	}{
+		{"10.1.2.3:1234", true},
+		{"[::ffff:10.1.2.3]:1234", true},
+		{"192.168.1.1:1234", true},
+		{"192.168.1.2:1234", false},
+		{"127.0.0.1:1234", false},
+	}
+
+	for _, c := range cases {
+		addr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(c.Addr))
+		if got := config.Trust(addr); got != c.Trust {
+			t.Errorf("ProxyProtocolConfig.Trust(%#v) must return %v, not %v", c.Addr, c.Trust, got)
+		}
+	}
+
+	// a header sent by an untrusted source is passed through as payload
+	tln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenTCP error: %+v", err)
+	}
+	defer tln.Close()
+
+	header, _ := AppendProxyProtocolHeader(nil, "v1", netip.MustParseAddrPort("1.2.3.4:1234"), netip.MustParseAddrPort("5.6.7.8:443"))
+	go func() {
+		c, err := net.Dial("tcp", tln.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write(header)
+		c.Close()
+	}()
+
+	conn, err := TCPListener{TCPListener: tln, ProxyProtocol: config}.Accept()
+	if err != nil {
+		t.Fatalf("TCPListener.Accept error: %+v", err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(*ProxyProtocolConn); ok {
+		t.Errorf("TCPListener.Accept must not parse proxy protocol from untrusted %s", conn.RemoteAddr())
+	}
+	if ip := AddrPortOf(conn.RemoteAddr()).Addr(); ip != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("untrusted conn RemoteAddr() must return 127.0.0.1, not %s", ip)
+	}
+	if data, _ := io.ReadAll(conn); !bytes.Equal(data, header) {
+		t.Errorf("untrusted conn must read %q, not %q", header, data)
+	}
+}
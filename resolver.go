@@ -3,8 +3,12 @@ package main
 import (
 	"cmp"
 	"context"
+	"fmt"
+	"math"
 	"net/netip"
 	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/phuslu/fastdns"
@@ -14,33 +18,239 @@ import (
 
 type Resolver struct {
 	*fastdns.Client
-	CacheDuration time.Duration
+	CacheDuration         time.Duration // the max ttl of cached answers
+	CacheMinDuration      time.Duration // the min ttl of cached answers
+	NegativeCacheDuration time.Duration // the ttl of empty answers, e.g. NXDOMAIN, NODATA and SERVFAIL
+	StaleCacheDuration    time.Duration // how long expired answers are served while refreshing in background
 
 	LRUCache *lru.TTLCache[string, []netip.Addr]
+
+	Hosts   *FileLoader[map[string][]netip.Addr]
+	Rules   []ResolverRule
+	GeoSite func(domain string) string
+
+	Upstreams       []*ResolverUpstream
+	Strategy        string // race, fallback or round_robin
+	UpstreamTimeout time.Duration
+
+	group    singleflight_Group[string, resolverAnswer]
+	next     atomic.Uint32
+	answered atomic.Pointer[ResolverUpstream]
+}
+
+// ResolverRule routes domains matching Domains suffixes or Geosite category to Resolver.
+type ResolverRule struct {
+	Domains  []string
+	Geosite  string
+	Resolver *Resolver
+}
+
+const (
+	resolverStaticTTL = 60 // ttl of hosts entries and ip literals
+	resolverStaleTTL  = 30 // ttl of stale answers, see RFC 8767
+)
+
+type resolverAnswer struct {
+	IPs []netip.Addr
+	TTL uint32
+}
+
+func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	ips, _, err := r.LookupNetIPTTL(ctx, network, host)
+	return ips, err
 }
 
-func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) (ips []netip.Addr, err error) {
+// LookupNetIPTTL is LookupNetIP but also returns the remaining ttl of answers in seconds.
+func (r *Resolver) LookupNetIPTTL(ctx context.Context, network, host string) (ips []netip.Addr, ttl uint32, err error) {
+	if r.Hosts != nil {
+		if hosts := r.Hosts.Load(); hosts != nil {
+			if v, ok := (*hosts)[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+				for _, ip := range v {
+					if network == "ip" || (network == "ip4") == ip.Is4() {
+						ips = append(ips, ip)
+					}
+				}
+				return ips, resolverStaticTTL, nil
+			}
+		}
+	}
+
+	if rr := r.route(host); rr != nil && rr != r {
+		return rr.LookupNetIPTTL(ctx, network, host)
+	}
+
 	if r.LRUCache != nil {
-		if v, ok := r.LRUCache.Get(host); ok {
-			return v, nil
+		// peek first, Get drops expired answers which are still needed for serving stale
+		if v, expires, ok := r.LRUCache.Peek(host); ok {
+			switch now := timeNow().UnixNano(); {
+			case expires == 0 || now < expires:
+				if v, ok := r.LRUCache.Get(host); ok {
+					ttl = uint32(r.CacheDuration / time.Second)
+					if expires > 0 {
+						ttl = uint32((expires - now + int64(time.Second) - 1) / int64(time.Second))
+					}
+					return v, ttl, nil
+				}
+			case r.StaleCacheDuration > 0 && len(v) > 0 && now < expires+int64(r.StaleCacheDuration):
+				go r.group.Do(network+"/"+host, func() (resolverAnswer, error) {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+					return r.lookup(ctx, network, host)
+				})
+				log.Debug().Str("host", host).Str("dns_server", r.Server()).Any("ips", v).Msg("LookupNetIP serve stale")
+				return v, resolverStaleTTL, nil
+			}
 		}
 	}
 
 	if ip, err := netip.ParseAddr(host); err == nil {
-		return []netip.Addr{ip}, nil
+		return []netip.Addr{ip}, resolverStaticTTL, nil
 	}
 
-	ips, err = r.Client.AppendLookupNetIP(ips, ctx, network, host)
-	if err != nil {
-		return nil, err
+	answer, err, _ := r.group.Do(network+"/"+host, func() (resolverAnswer, error) {
+		return r.lookup(ctx, network, host)
+	})
+
+	return answer.IPs, answer.TTL, err
+}
+
+func (r *Resolver) lookup(ctx context.Context, network, host string) (resolverAnswer, error) {
+	var ips []netip.Addr
+	var ttl uint32 = math.MaxUint32
+	var err error
+
+	switch network {
+	case "ip":
+		for _, network := range []string{"ip4", "ip6"} {
+			if ips, ttl, err = r.appendLookup(ips, ttl, ctx, network, host); err != nil {
+				return resolverAnswer{}, err
+			}
+		}
+	default:
+		if ips, ttl, err = r.appendLookup(ips, ttl, ctx, network, host); err != nil {
+			return resolverAnswer{}, err
+		}
 	}
 
 	slices.SortStableFunc(ips, func(a, b netip.Addr) int { return cmp.Compare(btoi(b.Is4()), btoi(a.Is4())) })
 
-	if r.LRUCache != nil && r.CacheDuration > 0 && len(ips) > 0 {
-		r.LRUCache.Set(host, ips, r.CacheDuration)
+	if len(ips) == 0 {
+		// empty answers carry no records, the ttl only matters to http caches of doh
+		ttl = uint32(r.NegativeCacheDuration / time.Second)
+	}
+
+	if r.LRUCache != nil {
+		switch {
+		case len(ips) > 0 && r.CacheDuration > 0:
+			if dur := min(max(time.Duration(ttl)*time.Second, r.CacheMinDuration), r.CacheDuration); dur >= time.Second {
+				r.LRUCache.Set(host, ips, dur)
+				ttl = uint32(dur / time.Second)
+			}
+		case len(ips) == 0 && r.NegativeCacheDuration >= time.Second:
+			r.LRUCache.Set(host, ips, r.NegativeCacheDuration)
+		}
+	}
+
+	log.Debug().Str("host", host).Str("dns_server", r.Server()).Any("ips", ips).Uint32("ttl", ttl).Msg("LookupNetIP")
+	return resolverAnswer{ips, ttl}, nil
+}
+
+// appendLookup appends A or AAAA records of host to dst and follows CNAME chains, ttl is lowered to the min ttl of records.
+func (r *Resolver) appendLookup(dst []netip.Addr, ttl uint32, ctx context.Context, network, host string) ([]netip.Addr, uint32, error) {
+	var typ fastdns.Type
+	switch network {
+	case "ip4":
+		typ = fastdns.TypeA
+	case "ip6":
+		typ = fastdns.TypeAAAA
+	default:
+		return nil, ttl, fastdns.ErrInvalidQuestion
+	}
+
+	req, resp := fastdns.AcquireMessage(), fastdns.AcquireMessage()
+	defer fastdns.ReleaseMessage(resp)
+	defer fastdns.ReleaseMessage(req)
+
+	for range 8 {
+		req.SetRequestQuestion(host, typ, fastdns.ClassINET)
+
+		if err := r.Exchange(ctx, req, resp); err != nil {
+			return nil, ttl, err
+		}
+
+		n := len(dst)
+		var cname []byte
+		for rr := range resp.Records {
+			ttl = min(ttl, rr.TTL)
+			switch rr.Type {
+			case fastdns.TypeCNAME:
+				cname = rr.Data
+			case fastdns.TypeA:
+				dst = append(dst, netip.AddrFrom4(*(*[4]byte)(rr.Data)))
+			case fastdns.TypeAAAA:
+				dst = append(dst, netip.AddrFrom16(*(*[16]byte)(rr.Data)))
+			}
+		}
+
+		if cname == nil || len(dst) > n {
+			break
+		}
+		host = string(resp.DecodeName(make([]byte, 0, 64), cname))
+	}
+
+	return dst, ttl, nil
+}
+
+func (r *Resolver) route(host string) *Resolver {
+	if len(r.Rules) == 0 {
+		return nil
 	}
 
-	log.Debug().Str("host", host).Str("dns_server", r.Client.Addr).Any("ips", ips).Msg("LookupNetIP")
-	return ips, nil
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var site string
+	for _, rule := range r.Rules {
+		for _, suffix := range rule.Domains {
+			if suffix = strings.TrimPrefix(suffix, "."); host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return rule.Resolver
+			}
+		}
+		if rule.Geosite != "" && r.GeoSite != nil {
+			if site == "" {
+				site = r.GeoSite(host)
+			}
+			if site == rule.Geosite {
+				return rule.Resolver
+			}
+		}
+	}
+
+	return nil
+}
+
+// HostsUnmarshal parses /etc/hosts style data into *map[string][]netip.Addr.
+func HostsUnmarshal(data []byte, v any) error {
+	hosts, ok := v.(*map[string][]netip.Addr)
+	if !ok {
+		return fmt.Errorf("*map[string][]netip.Addr required, found %T", v)
+	}
+	*hosts = make(map[string][]netip.Addr)
+	for _, line := range AppendSplitLines(nil, b2s(data)) {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid hosts line %#v: %w", line, err)
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			(*hosts)[name] = append((*hosts)[name], ip)
+		}
+	}
+	return nil
 }
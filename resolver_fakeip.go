@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// FakeIPPool hands out addresses of Prefix to domains and maps them back,
+// the oldest addresses are recycled once the pool is exhausted.
+type FakeIPPool struct {
+	Prefix netip.Prefix
+
+	mu      sync.Mutex
+	next    netip.Addr
+	domains map[netip.Addr]string
+	addrs   map[string]netip.Addr
+}
+
+func (p *FakeIPPool) Lookup(domain string) netip.Addr {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip, ok := p.addrs[domain]; ok {
+		return ip
+	}
+
+	if p.domains == nil {
+		p.domains = make(map[netip.Addr]string)
+		p.addrs = make(map[string]netip.Addr)
+	}
+
+	// skip the network address and keep the last address unused as broadcast
+	if !p.next.IsValid() || !p.Prefix.Contains(p.next.Next()) {
+		p.next = p.Prefix.Masked().Addr().Next()
+	}
+
+	ip := p.next
+	p.next = p.next.Next()
+
+	if old, ok := p.domains[ip]; ok {
+		delete(p.addrs, old)
+	}
+	p.domains[ip] = domain
+	p.addrs[domain] = ip
+
+	return ip
+}
+
+func (p *FakeIPPool) Reverse(ip netip.Addr) (string, bool) {
+	if !p.Prefix.Contains(ip.Unmap()) {
+		return "", false
+	}
+
+	p.mu.Lock()
+	domain, ok := p.domains[ip.Unmap()]
+	p.mu.Unlock()
+
+	return domain, ok
+}
+
+// ReverseHost translates a fake ip host or "host:port" address back to its domain, other inputs are returned unchanged.
+func (p *FakeIPPool) ReverseHost(host string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = host, ""
+	}
+
+	ip, err := netip.ParseAddr(h)
+	if err != nil {
+		return host
+	}
+
+	domain, ok := p.Reverse(ip)
+	if !ok {
+		return host
+	}
+
+	if port != "" {
+		return net.JoinHostPort(domain, port)
+	}
+	return domain
+}
@@ -15,6 +15,7 @@ type GeoResolver struct {
 	ISPReader            *maxminddb.Reader
 	DomainReader         *maxminddb.Reader
 	ConnectionTypeReader *maxminddb.Reader
+	FakeIP               *FakeIPPool
 	LocalizedName        bool
 }
 
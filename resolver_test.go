@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"net/netip"
 	"net/url"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -101,3 +104,177 @@ func TestResolverDoH3(t *testing.T) {
 		}
 	}
 }
+
+func TestResolverHosts(t *testing.T) {
+	filename := t.TempDir() + "/hosts"
+	if err := os.WriteFile(filename, []byte("127.0.0.1 localhost\n::1 localhost # loopback\n192.168.50.1 Router.LAN\n"), 0644); err != nil {
+		t.Fatalf("write hosts error: %+v", err)
+	}
+
+	lan := &Resolver{Client: &fastdns.Client{Addr: "192.168.50.1:53"}}
+	r := &Resolver{
+		Client: &fastdns.Client{Addr: "1.1.1.1:53"},
+		Hosts:  &FileLoader[map[string][]netip.Addr]{Filename: filename, Unmarshal: HostsUnmarshal},
+		Rules:  []ResolverRule{{Domains: []string{"lan"}, Resolver: lan}},
+	}
+
+	cases := []struct {
+		Network string
+		Host    string
+		IPs     string
+	}{
+		{"ip", "localhost", "[127.0.0.1 ::1]"},
+		{"ip4", "localhost", "[127.0.0.1]"},
+		{"ip6", "localhost.", "[::1]"},
+		{"ip", "router.lan", "[192.168.50.1]"},
+	}
+
+	for _, c := range cases {
+		ips, err := r.LookupNetIP(context.Background(), c.Network, c.Host)
+		if got := fmt.Sprint(ips); err != nil || got != c.IPs {
+			t.Errorf("LookupNetIP(%#v, %#v) must return %s, not %s, err=%+v", c.Network, c.Host, c.IPs, got, err)
+		}
+	}
+
+	if rr := r.route("nas.lan"); rr != lan {
+		t.Errorf("route(%#v) must return lan resolver", "nas.lan")
+	}
+	if rr := r.route("example.com"); rr != nil {
+		t.Errorf("route(%#v) must return nil", "example.com")
+	}
+}
+
+type resolverTestHandler struct {
+	IP    netip.Addr
+	Delay time.Duration
+	Count atomic.Int32
+}
+
+func (h *resolverTestHandler) ServeDNS(rw fastdns.ResponseWriter, req *fastdns.Message) {
+	h.Count.Add(1)
+	time.Sleep(h.Delay)
+	switch req.Question.Type {
+	case fastdns.TypeA:
+		fastdns.HOST1(rw, req, 60, h.IP)
+	case fastdns.TypeTXT:
+		fastdns.TXT(rw, req, 60, "liner")
+	default:
+		fastdns.HOST(rw, req, 60, nil)
+	}
+}
+
+// newResolverTestClient serves h on a local udp port and returns a client of it.
+func newResolverTestClient(t *testing.T, h fastdns.Handler) *fastdns.Client {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp error: %+v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go (&fastdns.Server{Handler: h, MaxProcs: 1}).Serve(conn)
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	return &fastdns.Client{
+		Addr:   addr.String(),
+		Dialer: &fastdns.UDPDialer{Addr: addr, Timeout: time.Second, MaxConns: 4},
+	}
+}
+
+func TestResolverServeStale(t *testing.T) {
+	h := &resolverTestHandler{IP: netip.MustParseAddr("2.2.2.2"), Delay: 200 * time.Millisecond}
+
+	r := &Resolver{
+		Client:             newResolverTestClient(t, h),
+		CacheDuration:      time.Minute,
+		StaleCacheDuration: time.Hour,
+		LRUCache:           lru.NewTTLCache[string, []netip.Addr](1024),
+	}
+
+	r.LRUCache.Set("stale.example.org", []netip.Addr{netip.MustParseAddr("1.1.1.1")}, time.Second)
+	time.Sleep(2100 * time.Millisecond)
+
+	start := time.Now()
+	ips, err := r.LookupNetIP(context.Background(), "ip4", "stale.example.org")
+	if got := fmt.Sprint(ips); err != nil || got != "[1.1.1.1]" {
+		t.Fatalf("LookupNetIP must serve stale [1.1.1.1], not %s, err=%+v", got, err)
+	}
+	if elapsed := time.Since(start); elapsed >= h.Delay {
+		t.Errorf("LookupNetIP must not wait for refreshing, elapsed=%s", elapsed)
+	}
+
+	for i := 0; i < 20; i++ {
+		if v, ok := r.LRUCache.Get("stale.example.org"); ok && fmt.Sprint(v) == "[2.2.2.2]" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ips, err = r.LookupNetIP(context.Background(), "ip4", "stale.example.org")
+	if got := fmt.Sprint(ips); err != nil || got != "[2.2.2.2]" {
+		t.Errorf("LookupNetIP must return refreshed [2.2.2.2], not %s, err=%+v", got, err)
+	}
+	if n := h.Count.Load(); n != 1 {
+		t.Errorf("dns server must be queried once by background refreshing, not %d", n)
+	}
+}
+
+func TestResolverLookupNetIPTTL(t *testing.T) {
+	r := &Resolver{
+		Client:             newResolverTestClient(t, &resolverTestHandler{IP: netip.MustParseAddr("2.2.2.2")}),
+		CacheDuration:      10 * time.Minute,
+		StaleCacheDuration: time.Hour,
+		LRUCache:           lru.NewTTLCache[string, []netip.Addr](1024),
+	}
+
+	if _, ttl, err := r.LookupNetIPTTL(context.Background(), "ip4", "www.example.org"); err != nil || ttl != 60 {
+		t.Errorf("LookupNetIPTTL must return the record ttl 60, not %d, err=%+v", ttl, err)
+	}
+
+	r.LRUCache.Set("short.example.org", []netip.Addr{netip.MustParseAddr("1.1.1.1")}, 5*time.Second)
+	if _, ttl, err := r.LookupNetIPTTL(context.Background(), "ip4", "short.example.org"); err != nil || ttl == 0 || ttl > 5 {
+		t.Errorf("LookupNetIPTTL must return the remaining ttl of cached answers, not %d, err=%+v", ttl, err)
+	}
+
+	r.LRUCache.Set("stale.example.org", []netip.Addr{netip.MustParseAddr("1.1.1.1")}, time.Second)
+	time.Sleep(2100 * time.Millisecond)
+	if _, ttl, err := r.LookupNetIPTTL(context.Background(), "ip4", "stale.example.org"); err != nil || ttl != resolverStaleTTL {
+		t.Errorf("LookupNetIPTTL must return %d for stale answers, not %d, err=%+v", resolverStaleTTL, ttl, err)
+	}
+}
+
+func TestResolverUpstreams(t *testing.T) {
+	good := newResolverTestClient(t, &resolverTestHandler{IP: netip.MustParseAddr("2.2.2.2")})
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen udp error: %+v", err)
+	}
+	conn.Close()
+	dead := &fastdns.Client{
+		Addr:   conn.LocalAddr().String(),
+		Dialer: &fastdns.UDPDialer{Addr: conn.LocalAddr().(*net.UDPAddr), Timeout: 200 * time.Millisecond, MaxConns: 8},
+	}
+
+	r := &Resolver{
+		Client:          &fastdns.Client{Addr: dead.Addr + ", " + good.Addr},
+		Upstreams:       []*ResolverUpstream{{Client: dead}, {Client: good}},
+		Strategy:        "fallback",
+		UpstreamTimeout: time.Second,
+	}
+	r.Client.Dialer = &ResolverExchangeDialer{Resolver: r}
+
+	// LookupTXT is promoted from fastdns.Client, it must not dial the joined addr
+	txt, err := r.LookupTXT(context.Background(), "example.org")
+	if got := fmt.Sprint(txt); err != nil || got != "[liner]" {
+		t.Errorf("LookupTXT must return [liner], not %s, err=%+v", got, err)
+	}
+
+	ips, err := r.LookupNetIP(context.Background(), "ip4", "example.org")
+	if got := fmt.Sprint(ips); err != nil || got != "[2.2.2.2]" {
+		t.Errorf("LookupNetIP must return [2.2.2.2], not %s, err=%+v", got, err)
+	}
+
+	if server := r.Server(); server != good.Addr {
+		t.Errorf("Server must return the answered upstream %#v, not %#v", good.Addr, server)
+	}
+}
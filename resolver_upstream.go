@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/fastdns"
+	"github.com/phuslu/log"
+)
+
+// ResolverUpstream is a dns upstream with passive health tracking,
+// it is marked down for a while after consecutive failures.
+type ResolverUpstream struct {
+	*fastdns.Client
+
+	failures  atomic.Int32
+	downUntil atomic.Int64
+}
+
+func (u *ResolverUpstream) Healthy() bool {
+	return u.downUntil.Load() < timeNow().UnixNano()
+}
+
+func (u *ResolverUpstream) exchange(ctx context.Context, req, resp *fastdns.Message, timeout time.Duration) error {
+	subctx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		subctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := u.Client.Exchange(subctx, req, resp)
+	if err != nil {
+		// the caller gave up, e.g. another upstream won the race
+		if ctx.Err() != nil {
+			return err
+		}
+		if n := u.failures.Add(1); n >= 3 {
+			u.downUntil.Store(timeNow().Add(time.Duration(min(n, 30)) * time.Second).UnixNano())
+			if n == 3 {
+				log.Warn().Err(err).Str("dns_server", u.Addr).Int32("dns_failures", n).Msg("dns upstream marked down")
+			}
+		}
+		return err
+	}
+
+	if u.failures.Swap(0) >= 3 {
+		log.Info().Str("dns_server", u.Addr).Msg("dns upstream recovered")
+	}
+	u.downUntil.Store(0)
+
+	return nil
+}
+
+// Exchange sends req to upstreams by Strategy, it shadows fastdns.Client.Exchange.
+func (r *Resolver) Exchange(ctx context.Context, req, resp *fastdns.Message) error {
+	if len(r.Upstreams) == 0 {
+		return r.Client.Exchange(ctx, req, resp)
+	}
+
+	upstreams := make([]*ResolverUpstream, 0, len(r.Upstreams))
+	for _, u := range r.Upstreams {
+		if u.Healthy() {
+			upstreams = append(upstreams, u)
+		}
+	}
+	if len(upstreams) == 0 {
+		upstreams = append(upstreams, r.Upstreams...)
+	}
+
+	switch r.Strategy {
+	case "race":
+		return r.race(ctx, upstreams, req, resp)
+	case "round_robin":
+		i := int(r.next.Add(1)-1) % len(upstreams)
+		upstreams = append(upstreams[i:], upstreams[:i]...)
+	}
+
+	var err error
+	for _, u := range upstreams {
+		if err = u.exchange(ctx, req, resp, r.UpstreamTimeout); err == nil {
+			r.answered.Store(u)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Debug().Err(err).Str("dns_server", u.Addr).Str("dns_strategy", r.Strategy).Msg("dns upstream exchange error")
+	}
+
+	return err
+}
+
+func (r *Resolver) race(ctx context.Context, upstreams []*ResolverUpstream, req, resp *fastdns.Message) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		Upstream *ResolverUpstream
+		Message  *fastdns.Message
+		Err      error
+	}
+
+	lane := make(chan result, len(upstreams))
+	for _, u := range upstreams {
+		go func(u *ResolverUpstream) {
+			msg := fastdns.AcquireMessage()
+			err := u.exchange(ctx, req, msg, r.UpstreamTimeout)
+			lane <- result{u, msg, err}
+		}(u)
+	}
+
+	var err error
+	for range upstreams {
+		res := <-lane
+		if res.Err != nil {
+			err = res.Err
+			fastdns.ReleaseMessage(res.Message)
+			continue
+		}
+		resp.Raw = append(resp.Raw[:0], res.Message.Raw...)
+		err = fastdns.ParseMessage(resp, resp.Raw, false)
+		fastdns.ReleaseMessage(res.Message)
+		r.answered.Store(res.Upstream)
+		return err
+	}
+
+	return err
+}
+
+// Server returns the dns server for logging, it is the upstream answered last if there are multiple upstreams.
+func (r *Resolver) Server() string {
+	if u := r.answered.Load(); u != nil {
+		return u.Addr
+	}
+	return r.Client.Addr
+}
+
+// ResolverExchangeDialer hands the queries of fastdns.Client lookups, e.g. LookupHTTPS, over to Resolver.Exchange,
+// so that they honor the strategy of multiple upstreams. It must not be used by a resolver without upstreams.
+type ResolverExchangeDialer struct {
+	Resolver *Resolver
+}
+
+func (d *ResolverExchangeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return &resolverExchangeConn{ctx: ctx, resolver: d.Resolver}, nil
+}
+
+// resolverExchangeConn exchanges the message written to it, fastdns.Client only calls Write and Read once per conn.
+type resolverExchangeConn struct {
+	net.Conn
+
+	ctx      context.Context
+	resolver *Resolver
+	req      []byte
+}
+
+func (c *resolverExchangeConn) Write(b []byte) (int, error) {
+	c.req = append(c.req[:0], b...)
+	return len(b), nil
+}
+
+func (c *resolverExchangeConn) Read(b []byte) (int, error) {
+	req, resp := fastdns.AcquireMessage(), fastdns.AcquireMessage()
+	defer fastdns.ReleaseMessage(resp)
+	defer fastdns.ReleaseMessage(req)
+
+	if err := fastdns.ParseMessage(req, c.req, true); err != nil {
+		return 0, err
+	}
+
+	if err := c.resolver.Exchange(c.ctx, req, resp); err != nil {
+		return 0, err
+	}
+
+	if len(resp.Raw) > len(b) {
+		return 0, io.ErrShortBuffer
+	}
+
+	return copy(b, resp.Raw), nil
+}
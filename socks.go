@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"net/netip"
 	"strconv"
 )
 
@@ -17,6 +21,7 @@ type SocksCommand byte
 const (
 	_                      SocksCommand = iota
 	SocksCommandConnectTCP              = 1
+	SocksCommandBind                    = 2
 	SocksCommandConnectUDP              = 3
 )
 
@@ -96,3 +101,83 @@ func (s Socks5Status) String() string {
 	}
 	return "socks5 status: errno 0x" + strconv.FormatInt(int64(s), 16)
 }
+
+// AppendSocks5Address appends ATYP, ADDR and PORT of a socks5 request or udp datagram header.
+func AppendSocks5Address(dst []byte, host string, port int) []byte {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip = ip.Unmap(); ip.Is4() {
+			b := ip.As4()
+			dst = append(append(dst, Socks5IPv4Address), b[:]...)
+		} else {
+			b := ip.As16()
+			dst = append(append(dst, Socks5IPv6Address), b[:]...)
+		}
+	} else {
+		dst = append(append(dst, Socks5DomainName, byte(len(host))), host...)
+	}
+	return append(dst, byte(port>>8), byte(port))
+}
+
+// ParseSocks5Address parses ATYP, ADDR and PORT in b and returns the remaining bytes.
+func ParseSocks5Address(b []byte) (host string, port int, rest []byte, err error) {
+	if len(b) < 1 {
+		return "", 0, nil, io.ErrUnexpectedEOF
+	}
+	var n int
+	switch Socks5AddressType(b[0]) {
+	case Socks5IPv4Address:
+		if n = 1 + 4; len(b) < n+2 {
+			return "", 0, nil, io.ErrUnexpectedEOF
+		}
+		host = netip.AddrFrom4([4]byte(b[1:n])).String()
+	case Socks5IPv6Address:
+		if n = 1 + 16; len(b) < n+2 {
+			return "", 0, nil, io.ErrUnexpectedEOF
+		}
+		host = netip.AddrFrom16([16]byte(b[1:n])).String()
+	case Socks5DomainName:
+		if len(b) < 2 {
+			return "", 0, nil, io.ErrUnexpectedEOF
+		}
+		if n = 2 + int(b[1]); len(b) < n+2 {
+			return "", 0, nil, io.ErrUnexpectedEOF
+		}
+		host = string(b[2:n])
+	default:
+		return "", 0, nil, errors.New("socks5: unsupported address type " + strconv.Itoa(int(b[0])))
+	}
+	return host, int(b[n])<<8 | int(b[n+1]), b[n+2:], nil
+}
+
+// ParseSocks4Request parses a socks4 or socks4a request, it returns io.ErrUnexpectedEOF if b is incomplete.
+//
+//	VN(1) CD(1) DSTPORT(2) DSTIP(4) USERID NUL [DOMAIN NUL]
+func ParseSocks4Request(b []byte) (cmd SocksCommand, host string, port int, userid string, err error) {
+	if len(b) < 9 {
+		return 0, "", 0, "", io.ErrUnexpectedEOF
+	}
+	if b[0] != VersionSocks4 {
+		return 0, "", 0, "", errors.New("socks4: unexpected version " + strconv.Itoa(int(b[0])))
+	}
+
+	i := bytes.IndexByte(b[8:], 0)
+	if i < 0 {
+		return 0, "", 0, "", io.ErrUnexpectedEOF
+	}
+
+	cmd, port, userid = SocksCommand(b[1]), int(b[2])<<8|int(b[3]), string(b[8:8+i])
+
+	// socks4a sets DSTIP to 0.0.0.x with x non-zero and appends the domain
+	if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
+		rest := b[9+i:]
+		j := bytes.IndexByte(rest, 0)
+		if j < 0 {
+			return 0, "", 0, "", io.ErrUnexpectedEOF
+		}
+		host = string(rest[:j])
+	} else {
+		host = netip.AddrFrom4([4]byte(b[4:8])).String()
+	}
+
+	return cmd, host, port, userid, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestSocks5Address(t *testing.T) {
+	cases := []struct {
+		Host string
+		Port int
+		Data []byte
+		Want string
+	}{
+		{"1.2.3.4", 443, []byte{0x01, 1, 2, 3, 4, 0x01, 0xbb}, "1.2.3.4"},
+		{"::ffff:1.2.3.4", 80, []byte{0x01, 1, 2, 3, 4, 0x00, 0x50}, "1.2.3.4"},
+		{"2001:db8::1", 53, []byte{0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x35}, "2001:db8::1"},
+		{"example.org", 65535, append(append([]byte{0x03, 11}, "example.org"...), 0xff, 0xff), "example.org"},
+	}
+
+	for _, c := range cases {
+		data := AppendSocks5Address(nil, c.Host, c.Port)
+		if !bytes.Equal(data, c.Data) {
+			t.Errorf("AppendSocks5Address(%#v, %d) must return %v, not %v", c.Host, c.Port, c.Data, data)
+		}
+
+		host, port, rest, err := ParseSocks5Address(append(data, "payload"...))
+		if err != nil || host != c.Want || port != c.Port || string(rest) != "payload" {
+			t.Errorf("ParseSocks5Address(%v) must return %#v %d \"payload\", not %#v %d %#v err=%+v", data, c.Want, c.Port, host, port, string(rest), err)
+		}
+	}
+}
+
+func TestSocks5AddressMalformed(t *testing.T) {
+	cases := []struct {
+		Data []byte
+		EOF  bool
+	}{
+		{nil, true},
+		{[]byte{0x01, 1, 2, 3, 4, 0x01}, true},
+		{[]byte{0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0x00, 0x35}, true},
+		{[]byte{0x03}, true},
+		{append([]byte{0x03, 11}, "example"...), true},
+		{append([]byte{0x03, 11}, "example.org"...), true},
+		{[]byte{0x02, 1, 2, 3, 4, 0x01, 0xbb}, false},
+		{[]byte{0x00}, false},
+	}
+
+	for _, c := range cases {
+		_, _, _, err := ParseSocks5Address(c.Data)
+		switch {
+		case err == nil:
+			t.Errorf("ParseSocks5Address(%v) must return error", c.Data)
+		case c.EOF && err != io.ErrUnexpectedEOF:
+			t.Errorf("ParseSocks5Address(%v) must return io.ErrUnexpectedEOF, not %+v", c.Data, err)
+		case !c.EOF && err == io.ErrUnexpectedEOF:
+			t.Errorf("ParseSocks5Address(%v) must return unsupported address type error, not %+v", c.Data, err)
+		}
+	}
+}
+
+func TestParseSocks4Request(t *testing.T) {
+	cases := []struct {
+		Data   []byte
+		Cmd    SocksCommand
+		Host   string
+		Port   int
+		UserID string
+	}{
+		{[]byte{0x04, 0x01, 0x01, 0xbb, 1, 2, 3, 4, 0x00}, SocksCommandConnectTCP, "1.2.3.4", 443, ""},
+		{append(append([]byte{0x04, 0x02, 0x00, 0x50, 1, 2, 3, 4}, "foo:123456"...), 0x00), SocksCommandBind, "1.2.3.4", 80, "foo:123456"},
+		{append(append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1}, "foo\x00example.org"...), 0x00), SocksCommandConnectTCP, "example.org", 80, "foo"},
+		{append(append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 0}, "foo"...), 0x00), SocksCommandConnectTCP, "0.0.0.0", 80, "foo"},
+	}
+
+	for _, c := range cases {
+		cmd, host, port, userid, err := ParseSocks4Request(c.Data)
+		if err != nil || cmd != c.Cmd || host != c.Host || port != c.Port || userid != c.UserID {
+			t.Errorf("ParseSocks4Request(%v) must return %d %#v %d %#v, not %d %#v %d %#v err=%+v", c.Data, c.Cmd, c.Host, c.Port, c.UserID, cmd, host, port, userid, err)
+		}
+	}
+}
+
+func TestParseSocks4RequestMalformed(t *testing.T) {
+	cases := []struct {
+		Data []byte
+		EOF  bool
+	}{
+		{nil, true},
+		{[]byte{0x04, 0x01, 0x01, 0xbb, 1, 2, 3, 4}, true},
+		{append([]byte{0x04, 0x01, 0x01, 0xbb, 1, 2, 3, 4}, "foo"...), true},
+		{append([]byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1}, "foo\x00example.org"...), true},
+		{[]byte{0x05, 0x01, 0x01, 0xbb, 1, 2, 3, 4, 0x00}, false},
+	}
+
+	for _, c := range cases {
+		_, _, _, _, err := ParseSocks4Request(c.Data)
+		switch {
+		case err == nil:
+			t.Errorf("ParseSocks4Request(%v) must return error", c.Data)
+		case c.EOF && err != io.ErrUnexpectedEOF:
+			t.Errorf("ParseSocks4Request(%v) must return io.ErrUnexpectedEOF, not %+v", c.Data, err)
+		case !c.EOF && err == io.ErrUnexpectedEOF:
+			t.Errorf("ParseSocks4Request(%v) must return unexpected version error, not %+v", c.Data, err)
+		}
+	}
+}
+
+func TestWriteSocksStatus(t *testing.T) {
+	cases := []struct {
+		Version SocksVersion
+		Status  Socks5Status
+		Bind    netip.AddrPort
+		Reply   []byte
+	}{
+		{VersionSocks4, Socks5StatusRequestGranted, netip.MustParseAddrPort("1.2.3.4:1080"), []byte{0x00, 0x5a, 0x04, 0x38, 1, 2, 3, 4}},
+		{VersionSocks4, Socks5StatusHostUnreachable, netip.AddrPort{}, []byte{0x00, 0x5b, 0, 0, 0, 0, 0, 0}},
+		{VersionSocks4, Socks5StatusRequestGranted, netip.MustParseAddrPort("[::1]:1080"), []byte{0x00, 0x5a, 0x04, 0x38, 0, 0, 0, 0}},
+		{VersionSocks5, Socks5StatusCommandNotSupported, netip.AddrPort{}, []byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0}},
+		{VersionSocks5, Socks5StatusRequestGranted, netip.MustParseAddrPort("1.2.3.4:1080"), []byte{0x05, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0x04, 0x38}},
+		{0, Socks5StatusRequestGranted, netip.AddrPort{}, nil},
+	}
+
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func() {
+			WriteSocksStatus(server, c.Version, c.Status, c.Bind)
+			server.Close()
+		}()
+		reply, _ := io.ReadAll(client)
+		client.Close()
+		if !bytes.Equal(reply, c.Reply) {
+			t.Errorf("WriteSocksStatus(%d, %d, %s) must write %v, not %v", c.Version, c.Status, c.Bind, c.Reply, reply)
+		}
+	}
+}
@@ -56,10 +56,11 @@ type TLSInspectorEntry struct {
 }
 
 type TLSInspectorSniproxy struct {
-	ServerName  string
-	ProxyPass   string
-	DialTimeout int
-	Dialer      Dialer
+	ServerName        string
+	ProxyPass         string
+	DialTimeout       int
+	SendProxyProtocol string
+	Dialer            Dialer
 }
 
 type TLSInspectorCacheKey struct {
@@ -109,16 +110,7 @@ func (m *TLSInspector) AddCertEntry(entry TLSInspectorEntry) error {
 	}
 
 	if m.RootCA == nil {
-		m.RootCA = &RootCA{
-			DirName:    "certs",
-			FileName:   "RootCA.crt",
-			CommonName: "RootCA",
-			Country:    "US",
-			Province:   "California",
-			Locality:   "Los Angeles",
-			Duration:   3 * 365 * 24 * time.Hour,
-			ForceRSA:   true,
-		}
+		m.RootCA = DefaultRootCA()
 	}
 
 	if net.ParseIP(entry.ServerName) != nil {
@@ -142,6 +134,12 @@ func (m *TLSInspector) AddCertEntry(entry TLSInspectorEntry) error {
 }
 
 func (m *TLSInspector) AddSniproxy(sniproxy TLSInspectorSniproxy) error {
+	switch sniproxy.SendProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("sniproxy %s: unsupported send_proxy_protocol %#v", sniproxy.ServerName, sniproxy.SendProxyProtocol)
+	}
+
 	if m.Sniproies == nil {
 		m.Sniproies = make(map[string]TLSInspectorSniproxy)
 	}
@@ -226,6 +224,12 @@ func (m *TLSInspector) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Conf
 			if err != nil {
 				return nil, fmt.Errorf("sniproxy: proxy_pass %s error: %w", sni.ProxyPass, err)
 			}
+			if sni.SendProxyProtocol != "" {
+				header, _ := AppendProxyProtocolHeader(nil, sni.SendProxyProtocol, AddrPortOf(hello.Conn.RemoteAddr()), AddrPortOf(hello.Conn.LocalAddr()))
+				if _, err = rconn.Write(header); err != nil {
+					return nil, fmt.Errorf("sniproxy: proxy_pass %s error: %w", sni.ProxyPass, err)
+				}
+			}
 			_, err = rconn.Write(mc.Header.B)
 			if err != nil {
 				return nil, fmt.Errorf("sniproxy: proxy_pass %s error: %w", sni.ProxyPass, err)
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+type UpstreamServer struct {
+	URL    *url.URL
+	Weight int
+
+	conns     atomic.Int64 // in-flight requests
+	fails     atomic.Int64 // failures within fail_timeout
+	failedAt  atomic.Int64 // unix nano of the first failure counted in fails
+	downUntil atomic.Int64 // unix nano, set when fails reach max_fails
+	unhealthy atomic.Bool  // set by health checks
+	current   int          // smooth weighted round-robin state, guarded by UpstreamPool.mu
+}
+
+// Available reports whether the server passes both the active health check and the passive failure counting.
+func (s *UpstreamServer) Available(now time.Time) bool {
+	return !s.unhealthy.Load() && now.UnixNano() >= s.downUntil.Load()
+}
+
+// UpstreamPool balances requests over weighted servers with round_robin, least_conn, ip_hash or cookie_hash.
+type UpstreamPool struct {
+	Servers             []*UpstreamServer
+	Balance             string
+	HashCookie          string
+	MaxFails            int
+	FailTimeout         time.Duration
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	Transport           http.RoundTripper
+
+	mu sync.Mutex
+}
+
+// NewUpstreamPool parses the server urls, weights default to 1.
+func NewUpstreamPool(urls []string, weights []int) (*UpstreamPool, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("upstream: empty servers")
+	}
+
+	pool := &UpstreamPool{}
+	for i, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("upstream: invalid server %#v: %w", s, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("upstream: invalid server %#v", s)
+		}
+		weight := 1
+		if i < len(weights) && weights[i] > 0 {
+			weight = weights[i]
+		}
+		pool.Servers = append(pool.Servers, &UpstreamServer{URL: u, Weight: weight})
+	}
+
+	return pool, nil
+}
+
+func (p *UpstreamPool) Load() error {
+	switch p.Balance {
+	case "":
+		p.Balance = "round_robin"
+	case "round_robin", "least_conn", "ip_hash":
+	case "cookie_hash":
+		if p.HashCookie == "" {
+			return fmt.Errorf("upstream: cookie_hash requires hash_cookie")
+		}
+	default:
+		return fmt.Errorf("upstream: unsupported balance %#v", p.Balance)
+	}
+
+	p.MaxFails = cmp.Or(p.MaxFails, 1)
+	p.FailTimeout = cmp.Or(p.FailTimeout, 10*time.Second)
+
+	if p.HealthCheckPath != "" {
+		p.HealthCheckInterval = cmp.Or(p.HealthCheckInterval, 10*time.Second)
+		p.HealthCheckTimeout = cmp.Or(p.HealthCheckTimeout, 5*time.Second)
+		go p.healthcheck(context.Background())
+	}
+
+	return nil
+}
+
+// Pick chooses an available server for the request, servers in tried are skipped. It returns nil if no server is live.
+func (p *UpstreamPool) Pick(req *http.Request, remoteIP string, tried []*UpstreamServer) *UpstreamServer {
+	now := time.Now()
+
+	servers := make([]*UpstreamServer, 0, len(p.Servers))
+	for _, s := range p.Servers {
+		if s.Available(now) && !slices.Contains(tried, s) {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+
+	switch p.Balance {
+	case "least_conn":
+		best := servers[0]
+		for _, s := range servers[1:] {
+			if s.conns.Load()*int64(best.Weight) < best.conns.Load()*int64(s.Weight) {
+				best = s
+			}
+		}
+		return best
+	case "ip_hash", "cookie_hash":
+		key := remoteIP
+		if p.Balance == "cookie_hash" {
+			if cookie, err := req.Cookie(p.HashCookie); err == nil && cookie.Value != "" {
+				key = cookie.Value
+			}
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(key))
+		total := 0
+		for _, s := range servers {
+			total += s.Weight
+		}
+		n := int(hash.Sum32() % uint32(total))
+		for _, s := range servers {
+			if n -= s.Weight; n < 0 {
+				return s
+			}
+		}
+		return servers[len(servers)-1]
+	default:
+		// smooth weighted round-robin, same as nginx
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		var best *UpstreamServer
+		total := 0
+		for _, s := range servers {
+			s.current += s.Weight
+			total += s.Weight
+			if best == nil || s.current > best.current {
+				best = s
+			}
+		}
+		best.current -= total
+		return best
+	}
+}
+
+// Acquire marks a request in flight on s, the returned func records its outcome.
+func (p *UpstreamPool) Acquire(s *UpstreamServer) func(failed bool) {
+	s.conns.Add(1)
+	return func(failed bool) {
+		s.conns.Add(-1)
+		if !failed {
+			s.fails.Store(0)
+			return
+		}
+		// failures older than fail_timeout are forgotten, like nginx counts max_fails per fail_timeout
+		now := time.Now().UnixNano()
+		if first := s.failedAt.Load(); s.fails.Load() == 0 || now-first > int64(p.FailTimeout) {
+			s.fails.Store(0)
+			s.failedAt.Store(now)
+		}
+		if s.fails.Add(1) >= int64(p.MaxFails) {
+			s.fails.Store(0)
+			s.downUntil.Store(time.Now().Add(p.FailTimeout).UnixNano())
+			log.Warn().Str("upstream_server", s.URL.String()).Int("max_fails", p.MaxFails).Dur("fail_timeout", p.FailTimeout).Msg("upstream server marked down")
+		}
+	}
+}
+
+// UpstreamBody releases its upstream server once the response body is closed, it stays writable for
+// 101 switching protocols responses.
+type UpstreamBody struct {
+	io.ReadCloser
+
+	once sync.Once
+	done func(failed bool)
+}
+
+func (b *UpstreamBody) Write(p []byte) (int, error) {
+	if w, ok := b.ReadCloser.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, errors.New("upstream: response body is not writable")
+}
+
+func (b *UpstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(false) })
+	return err
+}
+
+func (p *UpstreamPool) healthcheck(ctx context.Context) {
+	ticker := time.NewTicker(p.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, s := range p.Servers {
+			wg.Add(1)
+			go func(s *UpstreamServer) {
+				defer wg.Done()
+				err := p.probe(ctx, s)
+				switch {
+				case err != nil && !s.unhealthy.Swap(true):
+					log.Warn().Err(err).Str("upstream_server", s.URL.String()).Str("health_check_path", p.HealthCheckPath).Msg("upstream health check failed")
+				case err == nil && s.unhealthy.Swap(false):
+					log.Info().Str("upstream_server", s.URL.String()).Str("health_check_path", p.HealthCheckPath).Msg("upstream health check recovered")
+				}
+			}(s)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *UpstreamPool) probe(ctx context.Context, s *UpstreamServer) error {
+	ctx, cancel := context.WithTimeout(ctx, p.HealthCheckTimeout)
+	defer cancel()
+
+	u := *s.URL
+	u.Path, u.RawQuery, _ = strings.Cut(p.HealthCheckPath, "?")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("user-agent", "liner-healthcheck")
+
+	resp, err := p.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("upstream: health check status %d", resp.StatusCode)
+	}
+
+	return nil
+}
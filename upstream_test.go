@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newUpstreamTestPool(t *testing.T, balance string, weights ...int) *UpstreamPool {
+	var urls []string
+	for i := range weights {
+		urls = append(urls, fmt.Sprintf("http://10.0.0.%d", i+1))
+	}
+	pool, err := NewUpstreamPool(urls, weights)
+	if err != nil {
+		t.Fatalf("NewUpstreamPool error: %+v", err)
+	}
+	pool.Balance = balance
+	pool.HashCookie = "sid"
+	if err = pool.Load(); err != nil {
+		t.Fatalf("UpstreamPool.Load error: %+v", err)
+	}
+	return pool
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	pool := newUpstreamTestPool(t, "", 5, 1, 1)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// smooth weighted round-robin interleaves the light servers, same as nginx
+	var sb strings.Builder
+	for range 7 {
+		sb.WriteString(pool.Pick(req, "", nil).URL.Host[len("10.0.0."):])
+	}
+	if s := sb.String(); s != "1121311" {
+		t.Errorf("UpstreamPool.Pick(round_robin) must return order \"1121311\", not %#v", s)
+	}
+
+	counts := make(map[*UpstreamServer]int)
+	for range 700 {
+		counts[pool.Pick(req, "", nil)]++
+	}
+	for _, s := range pool.Servers {
+		if counts[s] != 100*s.Weight {
+			t.Errorf("UpstreamPool.Pick(round_robin) must pick %s %d times, not %d", s.URL.Host, 100*s.Weight, counts[s])
+		}
+	}
+}
+
+func TestUpstreamLeastConn(t *testing.T) {
+	pool := newUpstreamTestPool(t, "least_conn", 2, 1)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	a, b := pool.Servers[0], pool.Servers[1]
+
+	if s := pool.Pick(req, "", nil); s != a {
+		t.Fatalf("UpstreamPool.Pick(least_conn) must return %s for idle servers, not %s", a.URL.Host, s.URL.Host)
+	}
+
+	doneA := pool.Acquire(a)
+	if s := pool.Pick(req, "", nil); s != b {
+		t.Errorf("UpstreamPool.Pick(least_conn) must return idle %s, not %s", b.URL.Host, s.URL.Host)
+	}
+
+	doneB := pool.Acquire(b)
+	if s := pool.Pick(req, "", nil); s != a {
+		t.Errorf("UpstreamPool.Pick(least_conn) must return %s with the double weight, not %s", a.URL.Host, s.URL.Host)
+	}
+
+	doneA(false)
+	doneB(false)
+	if a.conns.Load() != 0 || b.conns.Load() != 0 {
+		t.Errorf("UpstreamPool.Acquire must release conns, not %d %d", a.conns.Load(), b.conns.Load())
+	}
+}
+
+func TestUpstreamHash(t *testing.T) {
+	pool := newUpstreamTestPool(t, "ip_hash", 1, 1, 1)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	seen := make(map[*UpstreamServer]bool)
+	for i := range 100 {
+		ip := fmt.Sprintf("192.168.1.%d", i)
+		s := pool.Pick(req, ip, nil)
+		for range 10 {
+			if got := pool.Pick(req, ip, nil); got != s {
+				t.Fatalf("UpstreamPool.Pick(ip_hash, %#v) must stick to %s, not %s", ip, s.URL.Host, got.URL.Host)
+			}
+		}
+		seen[s] = true
+	}
+	if len(seen) != len(pool.Servers) {
+		t.Errorf("UpstreamPool.Pick(ip_hash) must spread 100 ips over %d servers, not %d", len(pool.Servers), len(seen))
+	}
+
+	pool = newUpstreamTestPool(t, "cookie_hash", 1, 1, 1)
+	req.AddCookie(&http.Cookie{Name: "sid", Value: "abc"})
+	s := pool.Pick(req, "192.168.1.1", nil)
+	for i := range 10 {
+		ip := fmt.Sprintf("192.168.2.%d", i)
+		if got := pool.Pick(req, ip, nil); got != s {
+			t.Errorf("UpstreamPool.Pick(cookie_hash, %#v) must stick to %s, not %s", ip, s.URL.Host, got.URL.Host)
+		}
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	for _, balance := range []string{"round_robin", "least_conn", "ip_hash", "cookie_hash"} {
+		pool := newUpstreamTestPool(t, balance, 1, 1, 1)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		var tried []*UpstreamServer
+		for range pool.Servers {
+			s := pool.Pick(req, "192.168.1.1", tried)
+			if s == nil {
+				t.Fatalf("UpstreamPool.Pick(%s) must return an untried server, tried=%d", balance, len(tried))
+			}
+			for _, x := range tried {
+				if x == s {
+					t.Fatalf("UpstreamPool.Pick(%s) must skip tried server %s", balance, s.URL.Host)
+				}
+			}
+			tried = append(tried, s)
+		}
+		if s := pool.Pick(req, "192.168.1.1", tried); s != nil {
+			t.Errorf("UpstreamPool.Pick(%s) must return nil once all servers are tried, not %s", balance, s.URL.Host)
+		}
+	}
+}
+
+func TestUpstreamMaxFails(t *testing.T) {
+	pool := newUpstreamTestPool(t, "", 1)
+	pool.MaxFails = 2
+	pool.FailTimeout = 200 * time.Millisecond
+	s := pool.Servers[0]
+
+	// failures spread over more than fail_timeout never add up
+	pool.Acquire(s)(true)
+	time.Sleep(300 * time.Millisecond)
+	pool.Acquire(s)(true)
+	if !s.Available(time.Now()) {
+		t.Fatalf("UpstreamServer must stay available when failures are fail_timeout apart")
+	}
+
+	pool.Acquire(s)(true)
+	if s.Available(time.Now()) {
+		t.Fatalf("UpstreamServer must be down after max_fails within fail_timeout")
+	}
+	if !s.Available(time.Now().Add(pool.FailTimeout)) {
+		t.Errorf("UpstreamServer must be available again after fail_timeout")
+	}
+}
+
+func TestUpstreamProbeProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %+v", err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		Source string
+		Remote string
+		Err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			results <- result{Err: err}
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		source, err := ReadProxyProtocolHeader(br)
+		if err == nil {
+			_, err = http.ReadRequest(br)
+		}
+		if err == nil {
+			_, err = conn.Write([]byte("HTTP/1.1 200 OK\r\ncontent-length: 0\r\n\r\n"))
+		}
+		results <- result{fmt.Sprint(source), conn.RemoteAddr().String(), err}
+	}()
+
+	pool, err := NewUpstreamPool([]string{"http://" + ln.Addr().String()}, nil)
+	if err != nil {
+		t.Fatalf("NewUpstreamPool error: %+v", err)
+	}
+	h := &HTTPWebProxyHandler{
+		Transport:         &http.Transport{},
+		SendProxyProtocol: "v1",
+		Upstream:          pool,
+	}
+	if err = h.Load(); err != nil {
+		t.Fatalf("HTTPWebProxyHandler.Load error: %+v", err)
+	}
+
+	// probe once instead of the periodic health check started by Load
+	pool.HealthCheckPath = "/healthz"
+	pool.HealthCheckTimeout = 5 * time.Second
+
+	if err = pool.probe(context.Background(), pool.Servers[0]); err != nil {
+		t.Fatalf("UpstreamPool.probe error: %+v", err)
+	}
+	r := <-results
+	if r.Err != nil || r.Source != r.Remote {
+		t.Errorf("health check proxy protocol source must be %s, not %s err=%+v", r.Remote, r.Source, r.Err)
+	}
+}
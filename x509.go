@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -13,11 +14,14 @@ import (
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/phuslu/lru"
 )
 
 type RootCA struct {
@@ -31,9 +35,25 @@ type RootCA struct {
 	Duration   time.Duration
 	ForceRSA   bool
 
-	once sync.Once
-	ca   *x509.Certificate
-	priv interface{}
+	once   sync.Once
+	ca     *x509.Certificate
+	priv   interface{}
+	leaves *lru.TTLCache[string, *tls.Certificate]
+	group  singleflight_Group[string, *tls.Certificate]
+}
+
+// DefaultRootCA returns the root ca stored in certs/RootCA.crt, it is generated on first use.
+func DefaultRootCA() *RootCA {
+	return &RootCA{
+		DirName:    "certs",
+		FileName:   "RootCA.crt",
+		CommonName: "RootCA",
+		Country:    "US",
+		Province:   "California",
+		Locality:   "Los Angeles",
+		Duration:   3 * 365 * 24 * time.Hour,
+		ForceRSA:   true,
+	}
 }
 
 func (ca *RootCA) ext() string {
@@ -44,6 +64,8 @@ func (ca *RootCA) ext() string {
 }
 
 func (ca *RootCA) init() error {
+	ca.leaves = lru.NewTTLCache[string, *tls.Certificate](4096)
+
 	if _, err := os.Stat(ca.DirName); os.IsNotExist(err) {
 		os.Mkdir(ca.DirName, 0755)
 		if ca.Password != "" {
@@ -155,75 +177,105 @@ func (ca *RootCA) RootCertificate() *x509.Certificate {
 func (ca *RootCA) Issue(commonName string) error {
 	ca.once.Do(func() { ca.init() })
 
-	csrTemplate := &x509.CertificateRequest{
-		Signature: []byte(commonName),
-		Subject: pkix.Name{
-			Country:            []string{ca.Country},
-			Organization:       []string{commonName},
-			OrganizationalUnit: []string{ca.CommonName},
-			CommonName:         commonName,
-		},
-		DNSNames: []string{commonName},
+	priv, certBytes, err := ca.issue(commonName, timeNow().Add(-time.Duration(30*24*time.Hour)), timeNow().Add(ca.Duration))
+	if err != nil {
+		return err
 	}
 
-	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, csrTemplate, ca.priv)
+	var b bytes.Buffer
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		pem.Encode(&b, &pem.Block{Type: "PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	case *ecdsa.PrivateKey:
+		privBytes, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return err
+		}
+		pem.Encode(&b, &pem.Block{Type: "EC PRIVATE KEY", Bytes: privBytes})
+	}
+	pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+
+	err = os.WriteFile(filepath.Join(ca.DirName, commonName+ca.ext()), b.Bytes(), 0644)
 	if err != nil {
 		return err
 	}
 
-	csr, err := x509.ParseCertificateRequest(csrBytes)
+	return nil
+}
+
+// Certificate returns a leaf certificate of serverName signed by the root ca, leaves are minted in memory
+// and cached for a day.
+func (ca *RootCA) Certificate(serverName string) (*tls.Certificate, error) {
+	ca.once.Do(func() { ca.init() })
+
+	if ca.ca == nil || ca.priv == nil {
+		return nil, fmt.Errorf("root ca %#v is not available", filepath.Join(ca.DirName, ca.FileName))
+	}
+
+	if cert, ok := ca.leaves.Get(serverName); ok {
+		return cert, nil
+	}
+
+	cert, err, _ := ca.group.Do(serverName, func() (*tls.Certificate, error) {
+		priv, certBytes, err := ca.issue(serverName, timeNow().Add(-24*time.Hour), timeNow().Add(365*24*time.Hour))
+		if err != nil {
+			return nil, err
+		}
+		cert := &tls.Certificate{
+			Certificate: [][]byte{certBytes, ca.ca.Raw},
+			PrivateKey:  priv,
+		}
+		ca.leaves.Set(serverName, cert, 24*time.Hour)
+		return cert, nil
+	})
+
+	return cert, err
+}
+
+// issue signs a certificate of commonName with a new key pair, ip addresses are put into the ip SANs.
+func (ca *RootCA) issue(commonName string, notBefore, notAfter time.Time) (priv crypto.Signer, certBytes []byte, err error) {
+	if ca.ForceRSA {
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, nil, err
 	}
 
 	certTemplate := &x509.Certificate{
-		Subject:            csr.Subject,
-		DNSNames:           []string{commonName},
-		PublicKeyAlgorithm: csr.PublicKeyAlgorithm,
-		PublicKey:          csr.PublicKey,
-		SerialNumber:       big.NewInt(timeNow().UnixNano()),
-		NotBefore:          timeNow().Add(-time.Duration(30 * 24 * time.Hour)),
-		NotAfter:           timeNow().Add(ca.Duration),
-		KeyUsage:           x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		Subject: pkix.Name{
+			Country:            []string{ca.Country},
+			Organization:       []string{commonName},
+			OrganizationalUnit: []string{ca.CommonName},
+			CommonName:         commonName,
+		},
+		SerialNumber: serialNumber,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{
 			x509.ExtKeyUsageServerAuth,
 			x509.ExtKeyUsageClientAuth,
 		},
 	}
-
-	certBytes, err := x509.CreateCertificate(rand.Reader, certTemplate, ca.ca, csr.PublicKey, ca.priv)
-	if err != nil {
-		return err
-	}
-
-	var b bytes.Buffer
-	if ca.ForceRSA {
-		priv, err := rsa.GenerateKey(rand.Reader, 2048)
-		if err != nil {
-			return err
-		}
-		privBytes := x509.MarshalPKCS1PrivateKey(priv)
-		pem.Encode(&b, &pem.Block{Type: "PRIVATE KEY", Bytes: privBytes})
-		pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	if ip := net.ParseIP(commonName); ip != nil {
+		certTemplate.IPAddresses = []net.IP{ip}
 	} else {
-		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		if err != nil {
-			return err
-		}
-		privBytes, err := x509.MarshalECPrivateKey(priv)
-		if err != nil {
-			return err
-		}
-		pem.Encode(&b, &pem.Block{Type: "EC PRIVATE KEY", Bytes: privBytes})
-		pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+		certTemplate.DNSNames = []string{commonName}
 	}
 
-	err = os.WriteFile(filepath.Join(ca.DirName, commonName+ca.ext()), b.Bytes(), 0644)
+	certBytes, err = x509.CreateCertificate(rand.Reader, certTemplate, ca.ca, priv.Public(), ca.priv)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	return nil
+	return priv, certBytes, nil
 }
 
 func (ca *RootCA) Export(commonName, password string) error {
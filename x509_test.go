@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestRootCAIssue(t *testing.T) {
+	for _, forceRSA := range []bool{true, false} {
+		ca := DefaultRootCA()
+		ca.DirName = t.TempDir()
+		ca.ForceRSA = forceRSA
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.RootCertificate())
+
+		for _, name := range []string{"example.org", "192.168.1.1", "2001:db8::1"} {
+			if err := ca.Issue(name); err != nil {
+				t.Fatalf("RootCA(rsa=%v).Issue(%#v) error: %+v", forceRSA, name, err)
+			}
+
+			// the key of the issued file must match its certificate
+			filename := filepath.Join(ca.DirName, name+ca.ext())
+			cert, err := tls.LoadX509KeyPair(filename, filename)
+			if err != nil {
+				t.Fatalf("tls.LoadX509KeyPair(%#v) error: %+v", filename, err)
+			}
+
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatalf("x509.ParseCertificate(%#v) error: %+v", filename, err)
+			}
+			if _, err = leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+				t.Errorf("RootCA(rsa=%v).Issue(%#v) must verify against the root, error: %+v", forceRSA, name, err)
+			}
+
+			if ip := net.ParseIP(name); ip != nil && (len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(ip) || len(leaf.DNSNames) != 0) {
+				t.Errorf("RootCA(rsa=%v).Issue(%#v) must put the ip into IPAddresses, not %v %v", forceRSA, name, leaf.IPAddresses, leaf.DNSNames)
+			}
+		}
+	}
+}